@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	AdminRole = "admin"
+)
+
+// Access is the level of access a method requires
+type Access int
+
+const (
+	// Public methods don't need a token
+	Public Access = iota
+	// Authenticated methods need any valid token
+	Authenticated
+	// SelfOrAdmin methods need a token whose subject is the id in the request,
+	// unless the caller is an admin or holds the method permission
+	SelfOrAdmin
+	// AdminOnly methods need a token with the admin role or the method permission
+	AdminOnly
+)
+
+// Policy maps full method names (e.g. "/UserService/GetUser") to the access
+// they require, methods that aren't listed get Default. Permissions names the
+// permission that lets non-admin callers through SelfOrAdmin and AdminOnly methods.
+type Policy struct {
+	Methods     map[string]Access
+	Permissions map[string]string
+	Default     Access
+}
+
+func (policy Policy) access(method string) Access {
+	if access, ok := policy.Methods[method]; ok {
+		return access
+	}
+	return policy.Default
+}
+
+// Verifier checks an access token, TokenIssuer implements it
+type Verifier interface {
+	Verify(ctx context.Context, accessToken string) (*Claims, error)
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserId      string
+	Roles       []string
+	Permissions []string
+}
+
+func (principal *Principal) HasRole(role string) bool {
+	return slices.Contains(principal.Roles, role)
+}
+
+func (principal *Principal) HasPermission(permission string) bool {
+	return slices.Contains(principal.Permissions, permission)
+}
+
+type principalKey struct{}
+
+func NewContext(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the caller set by the interceptors, if any
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+// Authorizer validates the bearer token of every call and applies the Policy
+type Authorizer struct {
+	verifier Verifier
+	policy   Policy
+}
+
+func NewAuthorizer(verifier Verifier, policy Policy) *Authorizer {
+	return &Authorizer{verifier: verifier, policy: policy}
+}
+
+func (authorizer *Authorizer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authorizer.authorize(ctx, info.FullMethod, req)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor checks streams before the first message is read, so
+// SelfOrAdmin methods are treated as AdminOnly
+func (authorizer *Authorizer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorizer.authorize(stream.Context(), info.FullMethod, nil)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authorizedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+func (authorizer *Authorizer) authorize(ctx context.Context, method string, req any) (context.Context, error) {
+	access := authorizer.policy.access(method)
+	if access == Public {
+		return ctx, nil
+	}
+
+	token, err := bearerToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := authorizer.verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid access token")
+	}
+
+	principal := &Principal{UserId: claims.Subject, Roles: claims.Roles, Permissions: claims.Permissions}
+	ctx = NewContext(ctx, principal)
+
+	switch access {
+	case SelfOrAdmin:
+		if authorizer.privileged(principal, method) {
+			return ctx, nil
+		}
+		if target, ok := req.(interface{ GetId() string }); ok && target.GetId() == principal.UserId {
+			return ctx, nil
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "Not allowed to access this user")
+	case AdminOnly:
+		if !authorizer.privileged(principal, method) {
+			return nil, status.Errorf(codes.PermissionDenied, "Not allowed to call %s", method)
+		}
+	}
+
+	return ctx, nil
+}
+
+// privileged reports whether the principal is an admin or holds the method permission
+func (authorizer *Authorizer) privileged(principal *Principal, method string) bool {
+	if principal.HasRole(AdminRole) {
+		return true
+	}
+	permission, ok := authorizer.policy.Permissions[method]
+	return ok && principal.HasPermission(permission)
+}
+
+func bearerToken(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "Missing access token")
+	}
+
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", status.Errorf(codes.Unauthenticated, "Missing access token")
+	}
+
+	scheme, token, found := strings.Cut(values[0], " ")
+	if !found || !strings.EqualFold(scheme, TokenType) || token == "" {
+		return "", status.Errorf(codes.Unauthenticated, "Authorization must be a Bearer token")
+	}
+
+	return token, nil
+}
+
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *authorizedStream) Context() context.Context {
+	return stream.ctx
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type idRequest struct {
+	id string
+}
+
+func (req *idRequest) GetId() string {
+	return req.id
+}
+
+type fakeStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *fakeStream) Context() context.Context {
+	return stream.ctx
+}
+
+func TestAuthorizer(t *testing.T) {
+	ctx := context.Background()
+
+	issuer := NewHMACTokenIssuer([]byte("siuuu-secret"), NewInMemoryTokenStore())
+	authorizer := NewAuthorizer(issuer, Policy{
+		Methods: map[string]Access{
+			"/UserService/CreateUser": Public,
+			"/UserService/GetUser":    SelfOrAdmin,
+			"/UserService/ListUsers":  AdminOnly,
+			"/UserService/Whoami":     Authenticated,
+			"/UserService/DeleteUser": AdminOnly,
+		},
+		Permissions: map[string]string{
+			"/UserService/GetUser":    "users.read",
+			"/UserService/DeleteUser": "users.delete",
+		},
+		Default: AdminOnly,
+	})
+	unary := authorizer.UnaryServerInterceptor()
+
+	userTokens, err := issuer.Issue(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", nil, nil)
+	require.NoError(t, err)
+	adminTokens, err := issuer.Issue(ctx, "4bedafd6-b946-4d70-a156-d828ddcb62fb", []string{AdminRole}, nil)
+	require.NoError(t, err)
+
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+	}
+
+	call := func(ctx context.Context, method string, req any) (*Principal, error) {
+		var principal *Principal
+		_, err := unary(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req any) (any, error) {
+			principal, _ = PrincipalFromContext(ctx)
+			return nil, nil
+		})
+		return principal, err
+	}
+
+	t.Run("Public Method", func(t *testing.T) {
+		_, err := call(ctx, "/UserService/CreateUser", nil)
+		require.NoError(t, err)
+	})
+
+	t.Run("Missing Token", func(t *testing.T) {
+		_, err := call(ctx, "/UserService/Whoami", nil)
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("Invalid Token", func(t *testing.T) {
+		_, err := call(withToken("not-a-token"), "/UserService/Whoami", nil)
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		_, err = call(metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", userTokens.AccessToken)), "/UserService/Whoami", nil)
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("Principal In Context", func(t *testing.T) {
+		principal, err := call(withToken(userTokens.AccessToken), "/UserService/Whoami", nil)
+		require.NoError(t, err)
+		require.Equal(t, "86f9f466-851a-4b93-af21-d5f52ac91006", principal.UserId)
+	})
+
+	t.Run("Self Or Admin", func(t *testing.T) {
+		_, err := call(withToken(userTokens.AccessToken), "/UserService/GetUser", &idRequest{id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.NoError(t, err)
+
+		_, err = call(withToken(userTokens.AccessToken), "/UserService/GetUser", &idRequest{id: "4bedafd6-b946-4d70-a156-d828ddcb62fb"})
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		_, err = call(withToken(adminTokens.AccessToken), "/UserService/GetUser", &idRequest{id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.NoError(t, err)
+	})
+
+	t.Run("Admin Only", func(t *testing.T) {
+		_, err := call(withToken(userTokens.AccessToken), "/UserService/ListUsers", nil)
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		_, err = call(withToken(adminTokens.AccessToken), "/UserService/ListUsers", nil)
+		require.NoError(t, err)
+
+		// unlisted methods fall back to the default
+		_, err = call(withToken(userTokens.AccessToken), "/UserService/Unknown", nil)
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("Permissions", func(t *testing.T) {
+		supportTokens, err := issuer.Issue(ctx, "4bedafd6-b946-4d70-a156-d828ddcb62fb", []string{"support"}, []string{"users.read"})
+		require.NoError(t, err)
+
+		principal, err := call(withToken(supportTokens.AccessToken), "/UserService/GetUser", &idRequest{id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.NoError(t, err)
+		require.True(t, principal.HasPermission("users.read"))
+
+		_, err = call(withToken(supportTokens.AccessToken), "/UserService/DeleteUser", &idRequest{id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		// deleting your own account also needs the permission
+		_, err = call(withToken(userTokens.AccessToken), "/UserService/DeleteUser", &idRequest{id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("Revoked Token", func(t *testing.T) {
+		tokens, err := issuer.Issue(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", nil, nil)
+		require.NoError(t, err)
+		require.NoError(t, issuer.Revoke(ctx, tokens.AccessToken))
+
+		_, err = call(withToken(tokens.AccessToken), "/UserService/Whoami", nil)
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		stream := authorizer.StreamServerInterceptor()
+		handler := func(srv any, stream grpc.ServerStream) error {
+			_, ok := PrincipalFromContext(stream.Context())
+			require.True(t, ok)
+			return nil
+		}
+
+		err := stream(nil, &fakeStream{ctx: withToken(userTokens.AccessToken)}, &grpc.StreamServerInfo{FullMethod: "/UserService/GetUser"}, handler)
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		err = stream(nil, &fakeStream{ctx: withToken(adminTokens.AccessToken)}, &grpc.StreamServerInfo{FullMethod: "/UserService/GetUser"}, handler)
+		require.NoError(t, err)
+	})
+}
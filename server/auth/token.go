@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultIssuer          = "grpc-user"
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+	TokenType              = "Bearer"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrRevokedToken = errors.New("token has been revoked")
+)
+
+// Claims are the claims carried by an access token, the subject is the user id
+type Claims struct {
+	jwt.RegisteredClaims
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// Tokens is a freshly issued access and refresh token pair
+type Tokens struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    time.Duration
+}
+
+// TokenIssuer signs access tokens as JWTs and keeps track of refresh tokens and
+// revoked access tokens in a TokenStore
+type TokenIssuer struct {
+	method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+	store     TokenStore
+	now       func() time.Time
+
+	Issuer          string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+}
+
+// NewHMACTokenIssuer signs tokens with HS256 using a shared secret
+func NewHMACTokenIssuer(secret []byte, store TokenStore) *TokenIssuer {
+	return newTokenIssuer(jwt.SigningMethodHS256, secret, secret, store)
+}
+
+// NewEd25519TokenIssuer signs tokens with EdDSA, other services only need the public key to verify them
+func NewEd25519TokenIssuer(key ed25519.PrivateKey, store TokenStore) *TokenIssuer {
+	return newTokenIssuer(jwt.SigningMethodEdDSA, key, key.Public(), store)
+}
+
+func newTokenIssuer(method jwt.SigningMethod, signKey any, verifyKey any, store TokenStore) *TokenIssuer {
+	return &TokenIssuer{
+		method:          method,
+		signKey:         signKey,
+		verifyKey:       verifyKey,
+		store:           store,
+		now:             time.Now,
+		Issuer:          DefaultIssuer,
+		AccessTokenTTL:  DefaultAccessTokenTTL,
+		RefreshTokenTTL: DefaultRefreshTokenTTL,
+	}
+}
+
+// Issue creates a new access and refresh token pair for the subject, the roles
+// and permissions are embedded in the access token
+func (issuer *TokenIssuer) Issue(ctx context.Context, subject string, roles []string, permissions []string) (*Tokens, error) {
+	now := issuer.now()
+
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    issuer.Issuer,
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(issuer.AccessTokenTTL)),
+		},
+		Roles:       roles,
+		Permissions: permissions,
+	}
+
+	accessToken, err := jwt.NewWithClaims(issuer.method, claims).SignedString(issuer.signKey)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	err = issuer.store.SaveRefreshToken(ctx, &RefreshToken{
+		Hash:      hashToken(refreshToken),
+		Subject:   subject,
+		ExpiresAt: now.Add(issuer.RefreshTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    issuer.AccessTokenTTL,
+	}, nil
+}
+
+// Verify checks the signature, expiry and revocation of an access token
+func (issuer *TokenIssuer) Verify(ctx context.Context, accessToken string) (*Claims, error) {
+	claims, err := issuer.parse(accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := issuer.store.IsAccessTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrRevokedToken
+	}
+
+	return claims, nil
+}
+
+// Redeem consumes a refresh token and returns its subject, each refresh token
+// can only be used once
+func (issuer *TokenIssuer) Redeem(ctx context.Context, refreshToken string) (string, error) {
+	token, err := issuer.store.TakeRefreshToken(ctx, hashToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			return "", ErrInvalidToken
+		}
+		return "", err
+	}
+
+	if !issuer.now().Before(token.ExpiresAt) {
+		return "", ErrInvalidToken
+	}
+
+	return token.Subject, nil
+}
+
+// Revoke invalidates an access or refresh token. Unknown tokens are ignored so
+// callers can't use it to probe which tokens exist.
+func (issuer *TokenIssuer) Revoke(ctx context.Context, token string) error {
+	if claims, err := issuer.parse(token); err == nil {
+		return issuer.store.RevokeAccessToken(ctx, claims.ID, claims.ExpiresAt.Time)
+	}
+
+	_, err := issuer.store.TakeRefreshToken(ctx, hashToken(token))
+	if err != nil && !errors.Is(err, ErrTokenNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeSubject invalidates every refresh token issued to the subject, its
+// access tokens stay valid until they expire
+func (issuer *TokenIssuer) RevokeSubject(ctx context.Context, subject string) error {
+	return issuer.store.DeleteRefreshTokens(ctx, subject)
+}
+
+func (issuer *TokenIssuer) parse(accessToken string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(accessToken, &claims, func(token *jwt.Token) (any, error) {
+		return issuer.verifyKey, nil
+	},
+		jwt.WithValidMethods([]string{issuer.method.Alg()}),
+		jwt.WithIssuer(issuer.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(issuer.now),
+	)
+	if err != nil || claims.ID == "" || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+
+	return &claims, nil
+}
+
+func randomToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// refresh tokens are only stored hashed, so a leaked store can't be used to log in
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenNotFound = errors.New("token not found")
+)
+
+// RefreshToken is the stored form of a refresh token, only its hash is kept
+type RefreshToken struct {
+	Hash      string    `bson:"hash"`
+	Subject   string    `bson:"subject"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// TokenStore keeps the refresh tokens and the revoked access tokens
+type TokenStore interface {
+	SaveRefreshToken(ctx context.Context, token *RefreshToken) error
+	// TakeRefreshToken removes the refresh token with the given hash and returns it
+	TakeRefreshToken(ctx context.Context, hash string) (*RefreshToken, error)
+	// DeleteRefreshTokens removes every refresh token of the subject
+	DeleteRefreshTokens(ctx context.Context, subject string) error
+	// RevokeAccessToken denies the access token id until it expires
+	RevokeAccessToken(ctx context.Context, id string, expiresAt time.Time) error
+	IsAccessTokenRevoked(ctx context.Context, id string) (bool, error)
+}
+
+// InMemoryTokenStore is a thread-safe TokenStore kept in process memory
+type InMemoryTokenStore struct {
+	mu            sync.Mutex
+	refreshTokens map[string]RefreshToken
+	revoked       map[string]time.Time
+	now           func() time.Time
+}
+
+func NewInMemoryTokenStore() *InMemoryTokenStore {
+	return &InMemoryTokenStore{
+		refreshTokens: make(map[string]RefreshToken),
+		revoked:       make(map[string]time.Time),
+		now:           time.Now,
+	}
+}
+
+func (store *InMemoryTokenStore) SaveRefreshToken(ctx context.Context, token *RefreshToken) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.refreshTokens[token.Hash] = *token
+	return nil
+}
+
+func (store *InMemoryTokenStore) TakeRefreshToken(ctx context.Context, hash string) (*RefreshToken, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	token, ok := store.refreshTokens[hash]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	delete(store.refreshTokens, hash)
+
+	return &token, nil
+}
+
+func (store *InMemoryTokenStore) DeleteRefreshTokens(ctx context.Context, subject string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for hash, token := range store.refreshTokens {
+		if token.Subject == subject {
+			delete(store.refreshTokens, hash)
+		}
+	}
+	return nil
+}
+
+func (store *InMemoryTokenStore) RevokeAccessToken(ctx context.Context, id string, expiresAt time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// drop the revocations that expired on their own
+	now := store.now()
+	for revokedId, revokedUntil := range store.revoked {
+		if !now.Before(revokedUntil) {
+			delete(store.revoked, revokedId)
+		}
+	}
+
+	store.revoked[id] = expiresAt
+	return nil
+}
+
+func (store *InMemoryTokenStore) IsAccessTokenRevoked(ctx context.Context, id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	_, ok := store.revoked[id]
+	return ok, nil
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	refreshTokenCollection = "refresh_tokens"
+	revokedTokenCollection = "revoked_tokens"
+)
+
+// MongoTokenStore keeps tokens in the refresh_tokens and revoked_tokens collections
+type MongoTokenStore struct {
+	refreshTokens *mongo.Collection
+	revoked       *mongo.Collection
+}
+
+func NewMongoTokenStore(database *mongo.Database) *MongoTokenStore {
+	return &MongoTokenStore{
+		refreshTokens: database.Collection(refreshTokenCollection),
+		revoked:       database.Collection(revokedTokenCollection),
+	}
+}
+
+func (store *MongoTokenStore) SaveRefreshToken(ctx context.Context, token *RefreshToken) error {
+	_, err := store.refreshTokens.InsertOne(ctx, token)
+	return err
+}
+
+func (store *MongoTokenStore) TakeRefreshToken(ctx context.Context, hash string) (*RefreshToken, error) {
+	var token RefreshToken
+	err := store.refreshTokens.FindOneAndDelete(ctx, bson.M{"hash": hash}).Decode(&token)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrTokenNotFound
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (store *MongoTokenStore) DeleteRefreshTokens(ctx context.Context, subject string) error {
+	_, err := store.refreshTokens.DeleteMany(ctx, bson.M{"subject": subject})
+	return err
+}
+
+func (store *MongoTokenStore) RevokeAccessToken(ctx context.Context, id string, expiresAt time.Time) error {
+	_, err := store.revoked.UpdateOne(
+		ctx,
+		bson.M{"id": id},
+		bson.M{"$set": bson.M{"id": id, "expires_at": expiresAt}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (store *MongoTokenStore) IsAccessTokenRevoked(ctx context.Context, id string) (bool, error) {
+	count, err := store.revoked.CountDocuments(ctx, bson.M{"id": id}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// CreateTokenIndexes creates the lookup indexes and the TTL indexes that drop
+// expired tokens, it is run as a migration
+func CreateTokenIndexes(ctx context.Context, database *mongo.Database) error {
+	_, err := database.Collection(refreshTokenCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Collection(revokedTokenCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// CreateSubjectIndex indexes the refresh tokens by subject for
+// DeleteRefreshTokens, it is run as a migration
+func CreateSubjectIndex(ctx context.Context, database *mongo.Database) error {
+	_, err := database.Collection(refreshTokenCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "subject", Value: 1}},
+	})
+	return err
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenIssuer(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2025, 3, 22, 18, 37, 0, 0, time.UTC)
+	issuer := NewHMACTokenIssuer([]byte("siuuu-secret"), NewInMemoryTokenStore())
+	issuer.now = func() time.Time { return now }
+
+	t.Run("Issue And Verify", func(t *testing.T) {
+		tokens, err := issuer.Issue(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, DefaultAccessTokenTTL, tokens.ExpiresIn)
+
+		claims, err := issuer.Verify(ctx, tokens.AccessToken)
+		require.NoError(t, err)
+		require.Equal(t, "86f9f466-851a-4b93-af21-d5f52ac91006", claims.Subject)
+	})
+
+	t.Run("Expired Access Token", func(t *testing.T) {
+		tokens, err := issuer.Issue(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", nil, nil)
+		require.NoError(t, err)
+
+		later := NewHMACTokenIssuer([]byte("siuuu-secret"), issuer.store)
+		later.now = func() time.Time { return now.Add(DefaultAccessTokenTTL + time.Second) }
+
+		_, err = later.Verify(ctx, tokens.AccessToken)
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("Wrong Key", func(t *testing.T) {
+		tokens, err := issuer.Issue(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", nil, nil)
+		require.NoError(t, err)
+
+		other := NewHMACTokenIssuer([]byte("messi-secret"), issuer.store)
+		other.now = issuer.now
+
+		_, err = other.Verify(ctx, tokens.AccessToken)
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("Refresh Token Is Single Use", func(t *testing.T) {
+		tokens, err := issuer.Issue(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", nil, nil)
+		require.NoError(t, err)
+
+		subject, err := issuer.Redeem(ctx, tokens.RefreshToken)
+		require.NoError(t, err)
+		require.Equal(t, "86f9f466-851a-4b93-af21-d5f52ac91006", subject)
+
+		_, err = issuer.Redeem(ctx, tokens.RefreshToken)
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		tokens, err := issuer.Issue(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", nil, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, issuer.Revoke(ctx, tokens.AccessToken))
+		_, err = issuer.Verify(ctx, tokens.AccessToken)
+		require.ErrorIs(t, err, ErrRevokedToken)
+
+		require.NoError(t, issuer.Revoke(ctx, tokens.RefreshToken))
+		_, err = issuer.Redeem(ctx, tokens.RefreshToken)
+		require.ErrorIs(t, err, ErrInvalidToken)
+
+		require.NoError(t, issuer.Revoke(ctx, "not-a-token"))
+	})
+
+	t.Run("Revoke Subject", func(t *testing.T) {
+		first, err := issuer.Issue(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", nil, nil)
+		require.NoError(t, err)
+		second, err := issuer.Issue(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", nil, nil)
+		require.NoError(t, err)
+		other, err := issuer.Issue(ctx, "4bedafd6-b946-4d70-a156-d828ddcb62fb", nil, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, issuer.RevokeSubject(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006"))
+		for _, tokens := range []*Tokens{first, second} {
+			_, err = issuer.Redeem(ctx, tokens.RefreshToken)
+			require.ErrorIs(t, err, ErrInvalidToken)
+		}
+
+		subject, err := issuer.Redeem(ctx, other.RefreshToken)
+		require.NoError(t, err)
+		require.Equal(t, "4bedafd6-b946-4d70-a156-d828ddcb62fb", subject)
+	})
+
+	t.Run("Ed25519", func(t *testing.T) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		edIssuer := NewEd25519TokenIssuer(key, NewInMemoryTokenStore())
+		tokens, err := edIssuer.Issue(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", nil, nil)
+		require.NoError(t, err)
+
+		claims, err := edIssuer.Verify(ctx, tokens.AccessToken)
+		require.NoError(t, err)
+		require.Equal(t, "86f9f466-851a-4b93-af21-d5f52ac91006", claims.Subject)
+
+		// an HMAC token must not pass as an EdDSA one
+		hmacTokens, err := NewHMACTokenIssuer([]byte("siuuu-secret"), NewInMemoryTokenStore()).Issue(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", nil, nil)
+		require.NoError(t, err)
+		_, err = edIssuer.Verify(ctx, hmacTokens.AccessToken)
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"log"
 	"net"
+	"os"
 	"time"
 
 	"github.com/IBM/sarama"
@@ -14,6 +16,8 @@ import (
 	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
 
 	pb "github.com/zecst19/grpc-user/proto"
+	"github.com/zecst19/grpc-user/server/auth"
+	"github.com/zecst19/grpc-user/server/migrate"
 	userService "github.com/zecst19/grpc-user/server/user"
 )
 
@@ -22,6 +26,7 @@ var (
 	mongoURI    = "mongodb://localhost:27017"
 	dbName      = "userDB"
 	kafkaBroker = []string{"localhost:9092"}
+	kafkaTopic  = userService.DefaultTopic
 )
 
 func main() {
@@ -47,6 +52,33 @@ func main() {
 
 	log.Println("Connected to MongoDB")
 
+	// Bring the schema up to date, "go run server/main.go migrate" only migrates
+	// and exits, MIGRATE_ON_START=false skips it on boot
+	migrations := migrate.NewRunner(client.Database(dbName), migrate.NewMongoStore(client.Database(dbName)), userService.Migrations())
+
+	// backfills and index builds can take longer than the connection timeout
+	migrateCtx, cancelMigrate := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancelMigrate()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		applied, err := migrations.Up(migrateCtx)
+		if err != nil {
+			log.Fatalf("Failed to migrate: %v", err)
+		}
+		log.Printf("Migrations Applied:  %d", len(applied))
+		return
+	}
+
+	if os.Getenv("MIGRATE_ON_START") != "false" {
+		if _, err := migrations.Up(migrateCtx); err != nil {
+			log.Fatalf("Failed to migrate: %v", err)
+		}
+	} else if pending, err := migrations.Pending(migrateCtx); err != nil {
+		log.Printf("Failed to check pending migrations: %v", err)
+	} else if len(pending) > 0 {
+		log.Printf("%d migrations are pending, run the migrate command", len(pending))
+	}
+
 	config := sarama.NewConfig()
 	config.Producer.Return.Successes = true
 	config.Producer.RequiredAcks = sarama.WaitForAll
@@ -58,11 +90,62 @@ func main() {
 	}
 
 	// Create a new UserService instance
-	user_collection := client.Database(dbName).Collection("users")
-	user_service := userService.NewUserService(user_collection, producer)
+	user_collection := client.Database(dbName).Collection(userService.UserCollection)
+	user_repository := userService.NewMongoUserRepository(user_collection)
+	user_publisher := userService.NewKafkaPublisher(producer, kafkaTopic)
+
+	// Access tokens are signed with TOKEN_SIGNING_KEY, without it a random key is
+	// used and every token is invalidated on restart
+	signingKey := []byte(os.Getenv("TOKEN_SIGNING_KEY"))
+	if len(signingKey) == 0 {
+		log.Printf("TOKEN_SIGNING_KEY is not set, using a random signing key")
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			log.Fatalf("Failed to generate signing key: %v", err)
+		}
+	}
+
+	token_store := auth.NewMongoTokenStore(client.Database(dbName))
+	token_issuer := auth.NewHMACTokenIssuer(signingKey, token_store)
+
+	// LEGACY_TIMESTAMPS=false drops the deprecated string times once no client
+	// reads them anymore
+	user_service := userService.NewUserService(user_repository, user_publisher,
+		userService.WithTokenIssuer(token_issuer),
+		userService.WithLegacyTimestamps(os.Getenv("LEGACY_TIMESTAMPS") != "false"),
+	)
+
+	// Relay the events stored in the outbox to Kafka
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+
+	relay := userService.NewOutboxRelay(user_repository, user_publisher)
+	go relay.Run(relayCtx)
+
+	// Deleted users can be restored for PURGE_RETENTION (e.g. "720h"), then
+	// they are removed for good
+	retention := userService.DefaultPurgeRetention
+	if value := os.Getenv("PURGE_RETENTION"); value != "" {
+		retention, err = time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid PURGE_RETENTION: %v", err)
+		}
+	}
+
+	purger := userService.NewUserPurger(user_service, retention)
+	go purger.Run(relayCtx)
+
+	// Every call needs a bearer token unless the policy makes the method public
+	policy := userService.AccessPolicy()
+	policy.Methods["/grpc.health.v1.Health/Check"] = auth.Public
+	policy.Methods["/grpc.health.v1.Health/Watch"] = auth.Public
+	authorizer := auth.NewAuthorizer(token_issuer, policy)
 
 	// Create a new gRPC server
-	server := grpc.NewServer()
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(authorizer.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(authorizer.StreamServerInterceptor()),
+	)
 
 	log.Printf("GRPC Server created")
 
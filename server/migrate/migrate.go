@@ -0,0 +1,123 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migration is one versioned change to the database, such as creating indexes
+// or backfilling fields. Up may run again if the process dies before the
+// migration is recorded, so it must be safe to repeat.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+}
+
+// Record is an applied migration as kept in the Store
+type Record struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+// Store keeps track of the applied migrations
+type Store interface {
+	Applied(ctx context.Context) ([]Record, error)
+	Save(ctx context.Context, record Record) error
+}
+
+// Runner applies the pending migrations in version order
+type Runner struct {
+	db         *mongo.Database
+	store      Store
+	migrations []Migration
+	now        func() time.Time
+}
+
+func NewRunner(db *mongo.Database, store Store, migrations []Migration) *Runner {
+	sorted := slices.Clone(migrations)
+	slices.SortFunc(sorted, func(a, b Migration) int { return a.Version - b.Version })
+
+	return &Runner{db: db, store: store, migrations: sorted, now: time.Now}
+}
+
+// Pending returns the migrations that haven't been applied yet. It fails if the
+// store has versions this binary doesn't know, which means the database was
+// migrated by a newer release.
+func (runner *Runner) Pending(ctx context.Context) ([]Migration, error) {
+	if err := runner.validate(); err != nil {
+		return nil, err
+	}
+
+	applied, err := runner.store.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(map[int]bool, len(applied))
+	for _, record := range applied {
+		if !slices.ContainsFunc(runner.migrations, func(m Migration) bool { return m.Version == record.Version }) {
+			return nil, fmt.Errorf("database has unknown migration %d (%s), it was migrated by a newer release", record.Version, record.Description)
+		}
+		done[record.Version] = true
+	}
+
+	var pending []Migration
+	for _, migration := range runner.migrations {
+		if !done[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies the pending migrations and returns the ones it applied, it stops
+// at the first one that fails
+func (runner *Runner) Up(ctx context.Context) ([]Record, error) {
+	pending, err := runner.Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Record
+	for _, migration := range pending {
+		if err := migration.Up(ctx, runner.db); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+
+		record := Record{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedAt:   runner.now(),
+		}
+		if err := runner.store.Save(ctx, record); err != nil {
+			return applied, fmt.Errorf("record migration %d: %w", migration.Version, err)
+		}
+
+		log.Printf("Migration Applied:  %d %s", migration.Version, migration.Description)
+		applied = append(applied, record)
+	}
+
+	return applied, nil
+}
+
+func (runner *Runner) validate() error {
+	for i, migration := range runner.migrations {
+		if migration.Version <= 0 {
+			return fmt.Errorf("migration %q has invalid version %d", migration.Description, migration.Version)
+		}
+		if i > 0 && runner.migrations[i-1].Version == migration.Version {
+			return fmt.Errorf("migration version %d is used more than once", migration.Version)
+		}
+		if migration.Up == nil {
+			return fmt.Errorf("migration %d has no Up function", migration.Version)
+		}
+	}
+	return nil
+}
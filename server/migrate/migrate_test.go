@@ -0,0 +1,100 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestRunner(t *testing.T) {
+	ctx := context.Background()
+
+	var ran []int
+	migration := func(version int) Migration {
+		return Migration{
+			Version:     version,
+			Description: "test migration",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				ran = append(ran, version)
+				return nil
+			},
+		}
+	}
+
+	t.Run("Applies In Version Order", func(t *testing.T) {
+		ran = nil
+		store := NewInMemoryStore()
+		runner := NewRunner(nil, store, []Migration{migration(2), migration(1), migration(3)})
+
+		applied, err := runner.Up(ctx)
+		require.NoError(t, err)
+		require.Len(t, applied, 3)
+		require.Equal(t, []int{1, 2, 3}, ran)
+
+		records, err := store.Applied(ctx)
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+	})
+
+	t.Run("Skips Applied Migrations", func(t *testing.T) {
+		ran = nil
+		store := NewInMemoryStore()
+		_, err := NewRunner(nil, store, []Migration{migration(1)}).Up(ctx)
+		require.NoError(t, err)
+
+		runner := NewRunner(nil, store, []Migration{migration(1), migration(2)})
+		pending, err := runner.Pending(ctx)
+		require.NoError(t, err)
+		require.Len(t, pending, 1)
+		require.Equal(t, 2, pending[0].Version)
+
+		_, err = runner.Up(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []int{1, 2}, ran)
+
+		applied, err := runner.Up(ctx)
+		require.NoError(t, err)
+		require.Empty(t, applied)
+	})
+
+	t.Run("Stops At Failure", func(t *testing.T) {
+		ran = nil
+		store := NewInMemoryStore()
+		failing := Migration{
+			Version:     2,
+			Description: "broken",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				return errors.New("siuuu")
+			},
+		}
+
+		applied, err := NewRunner(nil, store, []Migration{migration(1), failing, migration(3)}).Up(ctx)
+		require.ErrorContains(t, err, "migration 2 (broken): siuuu")
+		require.Len(t, applied, 1)
+		require.Equal(t, []int{1}, ran)
+
+		records, err := store.Applied(ctx)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+	})
+
+	t.Run("Rejects Invalid Migrations", func(t *testing.T) {
+		_, err := NewRunner(nil, NewInMemoryStore(), []Migration{migration(1), migration(1)}).Up(ctx)
+		require.ErrorContains(t, err, "used more than once")
+
+		_, err = NewRunner(nil, NewInMemoryStore(), []Migration{migration(0)}).Up(ctx)
+		require.ErrorContains(t, err, "invalid version")
+	})
+
+	t.Run("Rejects Unknown Applied Versions", func(t *testing.T) {
+		store := NewInMemoryStore()
+		_, err := NewRunner(nil, store, []Migration{migration(1), migration(2)}).Up(ctx)
+		require.NoError(t, err)
+
+		_, err = NewRunner(nil, store, []Migration{migration(1)}).Pending(ctx)
+		require.ErrorContains(t, err, "newer release")
+	})
+}
@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MigrationCollection = "schema_migrations"
+)
+
+// MongoStore keeps the applied migrations in the schema_migrations collection,
+// one document per version
+type MongoStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoStore(database *mongo.Database) *MongoStore {
+	return &MongoStore{collection: database.Collection(MigrationCollection)}
+}
+
+func (store *MongoStore) Applied(ctx context.Context) ([]Record, error) {
+	cursor, err := store.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// Save upserts so two instances booting at once don't fail on the same version
+func (store *MongoStore) Save(ctx context.Context, record Record) error {
+	_, err := store.collection.ReplaceOne(
+		ctx,
+		bson.M{"_id": record.Version},
+		record,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// InMemoryStore is a Store kept in process memory, meant for tests
+type InMemoryStore struct {
+	mu      sync.Mutex
+	records []Record
+}
+
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{}
+}
+
+func (store *InMemoryStore) Applied(ctx context.Context) ([]Record, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return slices.Clone(store.records), nil
+}
+
+func (store *InMemoryStore) Save(ctx context.Context, record Record) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.records = slices.DeleteFunc(store.records, func(r Record) bool { return r.Version == record.Version })
+	store.records = append(store.records, record)
+	return nil
+}
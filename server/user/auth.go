@@ -0,0 +1,175 @@
+package grpc_user
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/zecst19/grpc-user/proto"
+	"github.com/zecst19/grpc-user/server/auth"
+)
+
+// AccessPolicy is the access each UserService method requires, users may only
+// read and change their own account unless they are admins or hold the
+// permission for the method
+func AccessPolicy() auth.Policy {
+	return auth.Policy{
+		Methods: map[string]auth.Access{
+			"/UserService/CreateUser":       auth.Public,
+			"/UserService/Authenticate":     auth.Public,
+			"/UserService/RefreshToken":     auth.Public,
+			"/UserService/RevokeToken":      auth.Public,
+			"/UserService/GetUser":          auth.SelfOrAdmin,
+			"/UserService/UpdateUser":       auth.SelfOrAdmin,
+			"/UserService/ChangePassword":   auth.SelfOrAdmin,
+			"/UserService/DeleteUser":       auth.AdminOnly,
+			"/UserService/ListUsers":        auth.AdminOnly,
+			"/UserService/SearchUsers":      auth.AdminOnly,
+			"/UserService/RestoreUser":      auth.AdminOnly,
+			"/UserService/BatchCreateUsers": auth.AdminOnly,
+			"/UserService/BatchGetUsers":    auth.AdminOnly,
+			"/UserService/ImportUsers":      auth.AdminOnly,
+			"/UserService/ExportUsers":      auth.AdminOnly,
+			"/UserService/AssignRole":       auth.AdminOnly,
+			"/UserService/RevokeRole":       auth.AdminOnly,
+			"/UserService/ListRoles":        auth.Authenticated,
+		},
+		Permissions: map[string]string{
+			"/UserService/GetUser":          PermissionUsersRead,
+			"/UserService/UpdateUser":       PermissionUsersWrite,
+			"/UserService/ChangePassword":   PermissionUsersWrite,
+			"/UserService/DeleteUser":       PermissionUsersDelete,
+			"/UserService/RestoreUser":      PermissionUsersDelete,
+			"/UserService/BatchCreateUsers": PermissionUsersWrite,
+			"/UserService/BatchGetUsers":    PermissionUsersRead,
+			"/UserService/ImportUsers":      PermissionUsersWrite,
+			"/UserService/ExportUsers":      PermissionUsersList,
+			"/UserService/ListUsers":        PermissionUsersList,
+			"/UserService/SearchUsers":      PermissionUsersList,
+			"/UserService/AssignRole":       PermissionRolesManage,
+			"/UserService/RevokeRole":       PermissionRolesManage,
+		},
+		Default: auth.AdminOnly,
+	}
+}
+
+// WithTokenIssuer enables Authenticate, RefreshToken and RevokeToken
+func WithTokenIssuer(issuer *auth.TokenIssuer) Option {
+	return func(svc *UserService) {
+		svc.tokenIssuer = issuer
+	}
+}
+
+func (svc *UserService) Authenticate(ctx context.Context, req *pb.AuthenticateRequest) (*pb.TokenResponse, error) {
+	if svc.tokenIssuer == nil {
+		return nil, status.Errorf(codes.Unimplemented, "Authentication is not configured")
+	}
+
+	user, err := svc.repository.FindByLogin(ctx, req.EmailOrNickname)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return nil, status.Errorf(codes.Internal, "Failed to get user: %v", err)
+	}
+	if user != nil && user.deleted() {
+		user = nil
+	}
+
+	if user == nil {
+		// compare anyway so unknown logins take as long as wrong passwords
+		checkPassword(svc.dummyPasswordHash(), req.Password)
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid credentials")
+	}
+
+	if !checkPassword(user.PasswordHash, req.Password) {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid credentials")
+	}
+
+	tokens, err := svc.tokenIssuer.Issue(ctx, user.Id, user.Roles, svc.permissions(user.Roles))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to issue token: %v", err)
+	}
+
+	log.Printf("User Authenticated:  %v", user.Id)
+
+	return toTokenResponse(tokens), nil
+}
+
+func (svc *UserService) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.TokenResponse, error) {
+	if svc.tokenIssuer == nil {
+		return nil, status.Errorf(codes.Unimplemented, "Authentication is not configured")
+	}
+
+	subject, err := svc.tokenIssuer.Redeem(ctx, req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			return nil, status.Errorf(codes.Unauthenticated, "Invalid refresh token")
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to redeem refresh token: %v", err)
+	}
+
+	user, err := svc.repository.Get(ctx, subject)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, status.Errorf(codes.Unauthenticated, "Invalid refresh token")
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to get user: %v", err)
+	}
+	if user.deleted() {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid refresh token")
+	}
+
+	tokens, err := svc.tokenIssuer.Issue(ctx, user.Id, user.Roles, svc.permissions(user.Roles))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to issue token: %v", err)
+	}
+
+	log.Printf("Token Refreshed:  %v", user.Id)
+
+	return toTokenResponse(tokens), nil
+}
+
+func (svc *UserService) RevokeToken(ctx context.Context, req *pb.RevokeTokenRequest) (*pb.RevokeTokenResponse, error) {
+	if svc.tokenIssuer == nil {
+		return nil, status.Errorf(codes.Unimplemented, "Authentication is not configured")
+	}
+
+	if err := svc.tokenIssuer.Revoke(ctx, req.Token); err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to revoke token: %v", err)
+	}
+
+	return &pb.RevokeTokenResponse{Success: true}, nil
+}
+
+func (svc *UserService) dummyPasswordHash() string {
+	svc.dummyHashOnce.Do(func() {
+		hash, err := svc.hashPassword("not-a-real-password-0")
+		if err != nil {
+			log.Printf("Failed to hash dummy password: %v", err)
+		}
+		svc.dummyHash = hash
+	})
+	return svc.dummyHash
+}
+
+// revokeRefreshTokens invalidates the refresh tokens of the user, if tokens
+// are issued at all
+func (svc *UserService) revokeRefreshTokens(ctx context.Context, id string) error {
+	if svc.tokenIssuer == nil {
+		return nil
+	}
+	if err := svc.tokenIssuer.RevokeSubject(ctx, id); err != nil {
+		return status.Errorf(codes.Internal, "Failed to revoke refresh tokens: %v", err)
+	}
+	return nil
+}
+
+func toTokenResponse(tokens *auth.Tokens) *pb.TokenResponse {
+	return &pb.TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		TokenType:    auth.TokenType,
+		ExpiresIn:    int64(tokens.ExpiresIn.Seconds()),
+	}
+}
@@ -0,0 +1,310 @@
+package grpc_user
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/google/uuid"
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+const (
+	// MaxBatchCreate bounds BatchCreateUsers, every user costs a bcrypt hash
+	MaxBatchCreate = 500
+	MaxBatchGet    = 1000
+)
+
+// WithHashWorkers sets how many passwords BatchCreateUsers hashes at once,
+// GOMAXPROCS by default
+func WithHashWorkers(workers int) Option {
+	return func(svc *UserService) {
+		svc.hashWorkers = max(workers, 1)
+	}
+}
+
+// BatchCreateUsers creates each user like CreateUser, a user that can't be
+// created gets an error result and doesn't stop the others
+func (svc *UserService) BatchCreateUsers(ctx context.Context, req *pb.BatchCreateUsersRequest) (*pb.BatchCreateUsersResponse, error) {
+	var v violations
+	switch {
+	case len(req.Requests) == 0:
+		v.add("requests", "at least one user is required")
+	case len(req.Requests) > MaxBatchCreate:
+		v.add("requests", "at most %d users can be created at once", MaxBatchCreate)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(req.Requests))
+	if err := svc.checkBatch(ctx, req.Requests, errs); err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to check users: %v", err)
+	}
+
+	created, err := svc.createUsers(ctx, req.Requests, errs)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.BatchCreateUsersResponse{Results: make([]*pb.BatchCreateUserResult, len(req.Requests))}
+	count := 0
+	for i, user := range created {
+		if errs[i] != nil {
+			response.Results[i] = &pb.BatchCreateUserResult{Result: &pb.BatchCreateUserResult_Error{Error: batchError(errs[i])}}
+			continue
+		}
+		response.Results[i] = &pb.BatchCreateUserResult{Result: &pb.BatchCreateUserResult_User{User: svc.toProto(user)}}
+		count++
+	}
+
+	log.Printf("Users Created:  %d of %d", count, len(req.Requests))
+
+	return response, nil
+}
+
+// createUsers hashes the passwords and creates the users of the requests without
+// an error, errs[i] is set for the ones that fail and created[i] for the others.
+// Taken emails and nicknames are left as DuplicateErrors.
+func (svc *UserService) createUsers(ctx context.Context, reqs []*pb.CreateUserRequest, errs []error) ([]*UserRecord, error) {
+	hashes, err := svc.hashPasswords(ctx, reqs, errs)
+	if err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+
+	var users []*UserRecord
+	var events [][]*OutboxMessage
+	var indexes []int
+	for i, in := range reqs {
+		if errs[i] != nil {
+			continue
+		}
+
+		user := &UserRecord{
+			Id:           uuid.New().String(),
+			FirstName:    in.FirstName,
+			LastName:     in.LastName,
+			Nickname:     in.Nickname,
+			PasswordHash: hashes[i],
+			Email:        normalizeEmail(in.Email),
+			Country:      in.Country,
+			CreatedAt:    storeTime(time.Now()),
+			UpdatedAt:    storeTime(time.Now()),
+			Version:      1,
+		}
+		userEvents, err := svc.outboxEvents("user.created", user.Id, newUserEvent(svc.toProto(user)))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to serialize event: %v", err)
+		}
+
+		users = append(users, user)
+		events = append(events, userEvents)
+		indexes = append(indexes, i)
+	}
+
+	created := make([]*UserRecord, len(reqs))
+	if len(users) > 0 {
+		createErrs, err := svc.repository.CreateMany(ctx, users, events)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to create users: %v", err)
+		}
+		for j, err := range createErrs {
+			var duplicate *DuplicateError
+			switch {
+			case errors.As(err, &duplicate):
+				errs[indexes[j]] = duplicate
+				continue
+			case err != nil:
+				errs[indexes[j]] = writeError(err, "create user")
+				continue
+			}
+			created[indexes[j]] = users[j]
+		}
+	}
+
+	return created, nil
+}
+
+// batchError is the status of a failed batch item
+func batchError(err error) *pb.BatchError {
+	var duplicate *DuplicateError
+	if errors.As(err, &duplicate) {
+		err = alreadyExists(duplicate.Field)
+	}
+	st := status.Convert(err).Proto()
+	return &pb.BatchError{Code: st.Code, Message: st.Message, Details: st.Details}
+}
+
+// checkBatch sets errs[i] for the requests without one that CreateUser would
+// reject before hashing, an email or nickname used earlier in the batch is taken as well.
+// Taken emails and nicknames are DuplicateErrors, they are looked up for the
+// whole batch in one query.
+func (svc *UserService) checkBatch(ctx context.Context, reqs []*pb.CreateUserRequest, errs []error) error {
+	emails := make(map[string]bool)
+	nicknames := make(map[string]bool)
+	var checkEmails, checkNicknames []string
+	for i, in := range reqs {
+		if errs[i] != nil {
+			continue
+		}
+		if err := svc.validateCreateUser(in); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		email := normalizeEmail(in.Email)
+		switch {
+		case emails[email]:
+			errs[i] = &DuplicateError{Field: "email"}
+			continue
+		case in.Nickname != "" && nicknames[in.Nickname]:
+			errs[i] = &DuplicateError{Field: "nickname"}
+			continue
+		}
+		emails[email] = true
+		checkEmails = append(checkEmails, email)
+		if in.Nickname != "" {
+			nicknames[in.Nickname] = true
+			checkNicknames = append(checkNicknames, in.Nickname)
+		}
+	}
+	if len(checkEmails) == 0 {
+		return nil
+	}
+
+	users, err := svc.repository.FindTaken(ctx, checkEmails, checkNicknames)
+	if err != nil {
+		return err
+	}
+	takenEmails := make(map[string]bool)
+	takenNicknames := make(map[string]bool)
+	for _, user := range users {
+		takenEmails[user.Email] = true
+		if user.Nickname != "" {
+			takenNicknames[user.Nickname] = true
+		}
+	}
+
+	for i, in := range reqs {
+		if errs[i] != nil {
+			continue
+		}
+		switch {
+		case takenEmails[normalizeEmail(in.Email)]:
+			errs[i] = &DuplicateError{Field: "email"}
+		case in.Nickname != "" && takenNicknames[in.Nickname]:
+			errs[i] = &DuplicateError{Field: "nickname"}
+		}
+	}
+	return nil
+}
+
+// hashPasswords hashes the passwords of the requests without an error in
+// svc.hashWorkers goroutines, a failed hash sets errs[i]
+func (svc *UserService) hashPasswords(ctx context.Context, reqs []*pb.CreateUserRequest, errs []error) ([]string, error) {
+	hashes := make([]string, len(reqs))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for range svc.hashWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				hashedPassword, err := svc.hashPassword(reqs[i].Password)
+				if err != nil {
+					errs[i] = status.Errorf(codes.Internal, "Failed to hash password: %v", err)
+					continue
+				}
+				hashes[i] = hashedPassword
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for i := range reqs {
+		if errs[i] != nil {
+			continue
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return hashes, err
+}
+
+// BatchGetUsers returns the users with the ids using a single query, ids
+// without a user, or with a deleted one unless show_deleted is set, are
+// reported as missing
+func (svc *UserService) BatchGetUsers(ctx context.Context, req *pb.BatchGetUsersRequest) (*pb.BatchGetUsersResponse, error) {
+	var v violations
+	switch {
+	case len(req.Ids) == 0:
+		v.add("ids", "at least one id is required")
+	case len(req.Ids) > MaxBatchGet:
+		v.add("ids", "at most %d users can be read at once", MaxBatchGet)
+	}
+	validateReadMask(&v, "read_mask", req.ReadMask)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	fields := readFields(req.ReadMask)
+	if len(fields) > 0 && !slices.Contains(fields, "deleted_at") {
+		fields = append(fields, "deleted_at")
+	}
+
+	records, err := svc.repository.GetMany(ctx, req.Ids, fields...)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to get users: %v", err)
+	}
+
+	found := make(map[string]*UserRecord, len(records))
+	for _, user := range records {
+		if !user.deleted() || req.ShowDeleted {
+			found[user.Id] = user
+		}
+	}
+
+	response := &pb.BatchGetUsersResponse{}
+	seen := make(map[string]bool)
+	for _, id := range req.Ids {
+		// a repeated id is answered once
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		user, ok := found[id]
+		if !ok {
+			response.MissingIds = append(response.MissingIds, id)
+			continue
+		}
+		response.Users = append(response.Users, pruneUser(svc.toProto(user), req.ReadMask))
+	}
+
+	log.Printf("Users Fetched:  %d", len(response.Users))
+
+	err = svc.publish(ctx, "user.batch_get", batchGetEvent{
+		Users:      newUserEvents(response.Users),
+		MissingIds: response.MissingIds,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to send Producer message: %v", err)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,161 @@
+package grpc_user
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// batchPublisher records the size of each batch it is given
+type batchPublisher struct {
+	RecordingPublisher
+	batches []int
+}
+
+func (pub *batchPublisher) PublishBatch(ctx context.Context, messages []Message) []error {
+	pub.batches = append(pub.batches, len(messages))
+	for _, message := range messages {
+		pub.RecordingPublisher.Publish(ctx, message)
+	}
+	return make([]error, len(messages))
+}
+
+// lookupRepository counts the uniqueness lookups
+type lookupRepository struct {
+	UserRepository
+	checkUnique int
+	findTaken   int
+}
+
+func (repo *lookupRepository) CheckUnique(ctx context.Context, id string, email string, nickname string) error {
+	repo.checkUnique++
+	return repo.UserRepository.CheckUnique(ctx, id, email, nickname)
+}
+
+func (repo *lookupRepository) FindTaken(ctx context.Context, emails []string, nicknames []string) ([]*UserRecord, error) {
+	repo.findTaken++
+	return repo.UserRepository.FindTaken(ctx, emails, nicknames)
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	require.NoError(t, user_repository.Create(ctx, &UserRecord{Id: "a", FirstName: "Cristiano", Nickname: "CR7", Email: "cristiano@ronaldo.com", Version: 1}))
+	publisher := &batchPublisher{}
+	svc := NewUserService(user_repository, publisher, WithBcryptCost(bcrypt.MinCost), WithHashWorkers(2))
+
+	newUser := func(nickname string, email string) *pb.CreateUserRequest {
+		return &pb.CreateUserRequest{FirstName: "Joao", LastName: "Felix", Nickname: nickname, Email: email, Country: "PT", Password: "Password123"}
+	}
+
+	var createdIds []string
+
+	t.Run("Create Reports Each User", func(t *testing.T) {
+		invalid := newUser("JF79", "joao@felix.com")
+		invalid.Country = "XX"
+
+		resp, err := svc.BatchCreateUsers(ctx, &pb.BatchCreateUsersRequest{Requests: []*pb.CreateUserRequest{
+			newUser("JF79", "Joao@Felix.com"),
+			invalid,
+			newUser("Felix", "joao@felix.com"),
+			newUser("CR7", "other@felix.com"),
+			newUser("Bruno", "bruno@fernandes.com"),
+		}})
+		require.NoError(t, err)
+		require.Len(t, resp.Results, 5)
+
+		require.Equal(t, "joao@felix.com", resp.Results[0].GetUser().Email)
+		require.Equal(t, "bruno@fernandes.com", resp.Results[4].GetUser().Email)
+		createdIds = []string{resp.Results[0].GetUser().Id, resp.Results[4].GetUser().Id}
+
+		require.Equal(t, int32(codes.InvalidArgument), resp.Results[1].GetError().Code)
+		require.Equal(t, int32(codes.AlreadyExists), resp.Results[2].GetError().Code)
+		require.Equal(t, int32(codes.AlreadyExists), resp.Results[3].GetError().Code)
+
+		var badRequest errdetails.BadRequest
+		require.NoError(t, resp.Results[3].GetError().Details[0].UnmarshalTo(&badRequest))
+		require.Equal(t, "nickname", badRequest.FieldViolations[0].Field)
+
+		stored, err := user_repository.Get(ctx, createdIds[0])
+		require.NoError(t, err)
+		require.True(t, checkPassword(stored.PasswordHash, "Password123"))
+	})
+
+	t.Run("Taken Logins Are Found In One Query", func(t *testing.T) {
+		lookups := &lookupRepository{UserRepository: NewInMemoryUserRepository()}
+		require.NoError(t, lookups.Create(ctx, &UserRecord{Id: "a", Nickname: "CR7", Email: "cristiano@ronaldo.com", Version: 1}))
+		batch := NewUserService(lookups, NewRecordingPublisher(), WithBcryptCost(bcrypt.MinCost))
+
+		resp, err := batch.BatchCreateUsers(ctx, &pb.BatchCreateUsersRequest{Requests: []*pb.CreateUserRequest{
+			newUser("JF79", "joao@felix.com"),
+			newUser("Bruno", "Cristiano@Ronaldo.com"),
+			newUser("CR7", "other@felix.com"),
+			newUser("Pepe", "pepe@example.com"),
+		}})
+		require.NoError(t, err)
+		require.NotNil(t, resp.Results[0].GetUser())
+		for i, field := range map[int]string{1: "email", 2: "nickname"} {
+			require.Equal(t, int32(codes.AlreadyExists), resp.Results[i].GetError().Code)
+			var badRequest errdetails.BadRequest
+			require.NoError(t, resp.Results[i].GetError().Details[0].UnmarshalTo(&badRequest))
+			require.Equal(t, field, badRequest.FieldViolations[0].Field)
+		}
+		require.NotNil(t, resp.Results[3].GetUser())
+
+		require.Equal(t, 1, lookups.findTaken)
+		require.Zero(t, lookups.checkUnique)
+	})
+
+	t.Run("Create Events Are Relayed In A Batch", func(t *testing.T) {
+		relay := NewOutboxRelay(user_repository, publisher)
+		delivered, err := relay.RelayOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 2, delivered)
+		require.Equal(t, []string{"user.created", "user.created"}, publisher.Events())
+		require.Equal(t, []int{2}, publisher.batches)
+	})
+
+	t.Run("Invalid Batches", func(t *testing.T) {
+		_, err := svc.BatchCreateUsers(ctx, &pb.BatchCreateUsersRequest{})
+		require.Equal(t, []string{"requests"}, fieldViolations(t, err))
+
+		_, err = svc.BatchGetUsers(ctx, &pb.BatchGetUsersRequest{Ids: make([]string, MaxBatchGet+1)})
+		require.Equal(t, []string{"ids"}, fieldViolations(t, err))
+	})
+
+	t.Run("Cancelled Create", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := svc.BatchCreateUsers(cancelled, &pb.BatchCreateUsersRequest{Requests: []*pb.CreateUserRequest{newUser("Pepe", "pepe@example.com")}})
+		require.Equal(t, codes.Canceled, status.Code(err))
+	})
+
+	t.Run("Get Reports Missing Ids", func(t *testing.T) {
+		_, err := svc.DeleteUser(ctx, &pb.DeleteUserRequest{Id: createdIds[1]})
+		require.NoError(t, err)
+
+		ids := []string{createdIds[0], "unknown", "a", createdIds[1], "a"}
+		resp, err := svc.BatchGetUsers(ctx, &pb.BatchGetUsersRequest{Ids: ids})
+		require.NoError(t, err)
+		require.Len(t, resp.Users, 2)
+		require.Equal(t, createdIds[0], resp.Users[0].Id)
+		require.Equal(t, "a", resp.Users[1].Id)
+		require.Equal(t, []string{"unknown", createdIds[1]}, resp.MissingIds)
+
+		resp, err = svc.BatchGetUsers(ctx, &pb.BatchGetUsersRequest{Ids: ids, ShowDeleted: true, ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"nickname"}}})
+		require.NoError(t, err)
+		require.Len(t, resp.Users, 3)
+		require.Equal(t, "JF79", resp.Users[0].Nickname)
+		require.Empty(t, resp.Users[0].Id)
+		require.Equal(t, []string{"unknown"}, resp.MissingIds)
+	})
+}
@@ -0,0 +1,109 @@
+package grpc_user
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	asyncPublishTimeout = 10 * time.Second
+)
+
+// DeliveryMode tells UserService how to emit an event type
+type DeliveryMode int
+
+const (
+	// DeliveryOff never emits the event
+	DeliveryOff DeliveryMode = iota
+	// DeliverySync emits the event before the RPC returns and fails the RPC if it can't
+	DeliverySync
+	// DeliveryAsync emits the event in the background, failures are only logged
+	DeliveryAsync
+	// DeliverySampled emits a SampleRate fraction of the events in the background
+	DeliverySampled
+)
+
+// EventPolicy is the delivery setting for one event type.
+// Write events always go through the outbox, so for them Sync and Async behave
+// the same and only Off and Sampled change what gets stored.
+type EventPolicy struct {
+	Mode       DeliveryMode
+	SampleRate float64
+}
+
+// DefaultEventPolicies emits every write event and none of the read ones
+func DefaultEventPolicies() map[string]EventPolicy {
+	return map[string]EventPolicy{
+		"user.created":          {Mode: DeliverySync},
+		"user.update":           {Mode: DeliverySync},
+		"user.deleted":          {Mode: DeliverySync},
+		"user.restored":         {Mode: DeliverySync},
+		"user.purged":           {Mode: DeliverySync},
+		"user.password_changed": {Mode: DeliverySync},
+		"user.role_changed":     {Mode: DeliverySync},
+		"user.get":              {Mode: DeliveryOff},
+		"user.list":             {Mode: DeliveryOff},
+		"user.search":           {Mode: DeliveryOff},
+		"user.batch_get":        {Mode: DeliveryOff},
+	}
+}
+
+// sampled reports whether an event with this policy should be emitted at all
+func (policy EventPolicy) sampled() bool {
+	switch policy.Mode {
+	case DeliveryOff:
+		return false
+	case DeliverySampled:
+		return rand.Float64() < policy.SampleRate
+	default:
+		return true
+	}
+}
+
+func (svc *UserService) eventPolicy(event string) EventPolicy {
+	if policy, ok := svc.eventPolicies[event]; ok {
+		return policy
+	}
+	return EventPolicy{Mode: DeliverySync}
+}
+
+// publish sends a read event straight to the publisher following its policy
+func (svc *UserService) publish(ctx context.Context, event string, value any) error {
+	policy := svc.eventPolicy(event)
+	if !policy.sampled() {
+		return nil
+	}
+
+	message := Message{Event: event, Value: value}
+	if policy.Mode == DeliverySync {
+		return svc.publisher.Publish(ctx, message)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), asyncPublishTimeout)
+		defer cancel()
+
+		if err := svc.publisher.Publish(ctx, message); err != nil {
+			log.Printf("Failed to send %v event: %v", event, err)
+		}
+	}()
+
+	return nil
+}
+
+// outboxEvents builds the outbox messages to store with a write to the user id
+// following its policy
+func (svc *UserService) outboxEvents(event string, id string, value any) ([]*OutboxMessage, error) {
+	if !svc.eventPolicy(event).sampled() {
+		return nil, nil
+	}
+
+	message, err := NewOutboxMessage(event, value)
+	if err != nil {
+		return nil, err
+	}
+	message.Key = id
+	return []*OutboxMessage{message}, nil
+}
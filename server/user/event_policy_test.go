@@ -0,0 +1,103 @@
+package grpc_user
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type failingPublisher struct{}
+
+func (failingPublisher) Publish(ctx context.Context, message Message) error {
+	return errors.New("kafka: client has run out of available brokers")
+}
+
+func TestEventPolicies(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	user_repository.Create(ctx, &UserRecord{Id: "86f9f466-851a-4b93-af21-d5f52ac91006", Country: "PT"})
+
+	t.Run("Reads Are Off By Default", func(t *testing.T) {
+		svc := NewUserService(user_repository, failingPublisher{})
+
+		_, err := svc.GetUser(ctx, &pb.GetUserRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.NoError(t, err)
+
+		_, err = svc.ListUsers(ctx, &pb.ListUsersRequest{Page: 1, PageSize: 10})
+		require.NoError(t, err)
+	})
+
+	t.Run("Sync Read Fails With Broker", func(t *testing.T) {
+		svc := NewUserService(user_repository, failingPublisher{},
+			WithEventPolicy("user.get", EventPolicy{Mode: DeliverySync}),
+		)
+
+		_, err := svc.GetUser(ctx, &pb.GetUserRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.Equal(t, codes.Internal, status.Code(err))
+	})
+
+	t.Run("Async Read Ignores Broker", func(t *testing.T) {
+		svc := NewUserService(user_repository, failingPublisher{},
+			WithEventPolicy("user.get", EventPolicy{Mode: DeliveryAsync}),
+		)
+
+		_, err := svc.GetUser(ctx, &pb.GetUserRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.NoError(t, err)
+	})
+
+	t.Run("Async Read Is Published", func(t *testing.T) {
+		publisher := NewRecordingPublisher()
+		svc := NewUserService(user_repository, publisher,
+			WithEventPolicy("user.list", EventPolicy{Mode: DeliveryAsync}),
+		)
+
+		_, err := svc.ListUsers(ctx, &pb.ListUsersRequest{Page: 1, PageSize: 10})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return len(publisher.Events()) == 1
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, []string{"user.list"}, publisher.Events())
+	})
+
+	t.Run("Sampled", func(t *testing.T) {
+		publisher := NewRecordingPublisher()
+		never := NewUserService(user_repository, publisher,
+			WithEventPolicy("user.get", EventPolicy{Mode: DeliverySampled, SampleRate: 0}),
+		)
+		always := NewUserService(user_repository, publisher,
+			WithEventPolicy("user.get", EventPolicy{Mode: DeliverySampled, SampleRate: 1}),
+		)
+
+		_, err := never.GetUser(ctx, &pb.GetUserRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.NoError(t, err)
+		_, err = always.GetUser(ctx, &pb.GetUserRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return len(publisher.Events()) == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Write Event Off", func(t *testing.T) {
+		repository := NewInMemoryUserRepository()
+		repository.Create(ctx, &UserRecord{Id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+
+		svc := NewUserService(repository, nil,
+			WithEventPolicy("user.deleted", EventPolicy{Mode: DeliveryOff}),
+		)
+
+		_, err := svc.DeleteUser(ctx, &pb.DeleteUserRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.NoError(t, err)
+
+		pending, err := repository.PendingOutbox(ctx, time.Now(), 10)
+		require.NoError(t, err)
+		require.Empty(t, pending)
+	})
+}
@@ -0,0 +1,212 @@
+package grpc_user
+
+import (
+	"bytes"
+	"encoding/csv"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+const (
+	// exportBatchSize is how many users go in a message without a format, and
+	// how many users the MongoDB repository reads per page
+	exportBatchSize = 500
+	// exportChunkSize is the size a CSV or NDJSON chunk is sent at
+	exportChunkSize = 64 * 1024
+)
+
+// exportFields are the stored fields exported without a read mask, the
+// password hash is never exported
+var exportFields = []string{
+	"id", "first_name", "last_name", "nickname", "email", "country",
+	"created_at", "updated_at", "roles", "version", "deleted_at",
+}
+
+// ExportUsers streams every user matching the filter in id order, read a page
+// at a time. Users are sent as the client receives them, a slow client slows
+// the reads down instead of filling the server memory.
+func (svc *UserService) ExportUsers(req *pb.ExportUsersRequest, stream pb.UserService_ExportUsersServer) error {
+	var v violations
+	validateReadMask(&v, "read_mask", req.ReadMask)
+	if _, ok := pb.ExportFormat_name[int32(req.Format)]; !ok {
+		v.add("format", "unknown format %d", req.Format)
+	}
+	var filter Filter
+	if strings.TrimSpace(req.Filter) != "" {
+		parsed, err := parseFilter(req.Filter)
+		if err != nil {
+			v.add("filter", "%v", err)
+		}
+		filter = parsed
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	fields := readFields(req.ReadMask)
+	if len(fields) == 0 {
+		fields = exportFields
+	}
+
+	exp, err := newUserExport(stream, req)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to export users: %v", err)
+	}
+
+	ctx := stream.Context()
+	err = svc.repository.Export(ctx, ListQuery{
+		Filter: visibleUsers(filter, req.ShowDeleted),
+		Sort:   []SortField{{Field: "id"}},
+		Fields: fields,
+	}, func(user *UserRecord) error {
+		return exp.add(pruneUser(svc.toProto(user), req.ReadMask))
+	})
+	if err == nil {
+		err = exp.flush()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		// failed sends already have a status
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Errorf(codes.Internal, "Failed to export users: %v", err)
+	}
+
+	log.Printf("Users Exported:  %d", exp.count)
+
+	return nil
+}
+
+// userExport buffers the users of one ExportUsers call into messages
+type userExport struct {
+	stream pb.UserService_ExportUsersServer
+	format pb.ExportFormat
+	count  int
+
+	users  []*pb.User
+	buffer bytes.Buffer
+	csv    *csv.Writer
+	// columns are the User fields of the CSV rows
+	columns []protoreflect.FieldDescriptor
+}
+
+// newUserExport writes the CSV header, the columns are the masked fields or
+// the User fields that aren't deprecated
+func newUserExport(stream pb.UserService_ExportUsersServer, req *pb.ExportUsersRequest) (*userExport, error) {
+	exp := &userExport{stream: stream, format: req.Format}
+	if exp.format != pb.ExportFormat_EXPORT_FORMAT_CSV {
+		return exp, nil
+	}
+
+	fields := (&pb.User{}).ProtoReflect().Descriptor().Fields()
+	if paths := req.ReadMask.GetPaths(); len(paths) > 0 {
+		for _, path := range paths {
+			exp.columns = append(exp.columns, fields.ByName(protoreflect.Name(path)))
+		}
+	} else {
+		for i := range fields.Len() {
+			field := fields.Get(i)
+			if !field.Options().(*descriptorpb.FieldOptions).GetDeprecated() {
+				exp.columns = append(exp.columns, field)
+			}
+		}
+	}
+
+	header := make([]string, len(exp.columns))
+	for i, column := range exp.columns {
+		header[i] = string(column.Name())
+	}
+	exp.csv = csv.NewWriter(&exp.buffer)
+	if err := exp.csv.Write(header); err != nil {
+		return nil, err
+	}
+	exp.csv.Flush()
+	return exp, exp.csv.Error()
+}
+
+// add encodes the user and sends the buffered users once there are enough
+func (exp *userExport) add(user *pb.User) error {
+	exp.count++
+
+	switch exp.format {
+	case pb.ExportFormat_EXPORT_FORMAT_CSV:
+		if err := exp.csv.Write(csvRecord(user, exp.columns)); err != nil {
+			return status.Errorf(codes.Internal, "Failed to encode user: %v", err)
+		}
+		exp.csv.Flush()
+	case pb.ExportFormat_EXPORT_FORMAT_NDJSON:
+		line, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(user)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Failed to encode user: %v", err)
+		}
+		exp.buffer.Write(line)
+		exp.buffer.WriteByte('\n')
+	default:
+		exp.users = append(exp.users, user)
+	}
+
+	if len(exp.users) >= exportBatchSize || exp.buffer.Len() >= exportChunkSize {
+		return exp.flush()
+	}
+	return nil
+}
+
+// flush sends the buffered users, if any
+func (exp *userExport) flush() error {
+	if len(exp.users) == 0 && exp.buffer.Len() == 0 {
+		return nil
+	}
+
+	response := &pb.ExportUsersResponse{Users: exp.users}
+	if exp.buffer.Len() > 0 {
+		response.Chunk = bytes.Clone(exp.buffer.Bytes())
+	}
+	exp.users = nil
+	exp.buffer.Reset()
+
+	return exp.stream.Send(response)
+}
+
+// csvRecord formats the columns of the user, times as RFC 3339 and lists
+// separated by ";"
+func csvRecord(user *pb.User, columns []protoreflect.FieldDescriptor) []string {
+	message := user.ProtoReflect()
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		if !message.Has(column) {
+			continue
+		}
+		value := message.Get(column)
+		switch {
+		case column.IsList():
+			list := value.List()
+			values := make([]string, list.Len())
+			for j := range list.Len() {
+				values[j] = list.Get(j).String()
+			}
+			record[i] = strings.Join(values, ";")
+		case column.Kind() == protoreflect.MessageKind:
+			t := value.Message().Interface().(*timestamppb.Timestamp)
+			record[i] = t.AsTime().Format(time.RFC3339Nano)
+		case column.Kind() == protoreflect.Int64Kind:
+			record[i] = strconv.FormatInt(value.Int(), 10)
+		default:
+			record[i] = value.String()
+		}
+	}
+	return record
+}
@@ -0,0 +1,258 @@
+package grpc_user
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// exportStream keeps the sent responses, sends fail once failAfter are sent
+type exportStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses []*pb.ExportUsersResponse
+	failAfter int
+}
+
+func (stream *exportStream) Context() context.Context {
+	if stream.ctx != nil {
+		return stream.ctx
+	}
+	return context.Background()
+}
+
+func (stream *exportStream) Send(response *pb.ExportUsersResponse) error {
+	if stream.failAfter > 0 && len(stream.responses) == stream.failAfter {
+		return status.Error(codes.Unavailable, "transport is closing")
+	}
+	stream.responses = append(stream.responses, response)
+	return nil
+}
+
+func (stream *exportStream) users() []*pb.User {
+	var users []*pb.User
+	for _, response := range stream.responses {
+		users = append(users, response.Users...)
+	}
+	return users
+}
+
+func (stream *exportStream) payload() []byte {
+	var payload []byte
+	for _, response := range stream.responses {
+		payload = append(payload, response.Chunk...)
+	}
+	return payload
+}
+
+func TestExportUsers(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	created := testTime("2025-03-01T10:00:00Z")
+	for i := range exportBatchSize + 2 {
+		require.NoError(t, user_repository.Create(ctx, &UserRecord{
+			Id:           fmt.Sprintf("user-%04d", i),
+			FirstName:    "Player",
+			LastName:     fmt.Sprintf("Number %d", i),
+			Nickname:     fmt.Sprintf("player%d", i),
+			PasswordHash: "hash",
+			Email:        fmt.Sprintf("player%d@club.com", i),
+			Country:      "PT",
+			CreatedAt:    created,
+			UpdatedAt:    created,
+			Version:      1,
+		}))
+	}
+	require.NoError(t, user_repository.Create(ctx, &UserRecord{
+		Id:           "cr7",
+		FirstName:    "Cristiano",
+		LastName:     "Ronaldo, Jr",
+		Nickname:     "CR7",
+		PasswordHash: "hash",
+		Email:        "cristiano@ronaldo.com",
+		Country:      "SA",
+		CreatedAt:    created,
+		UpdatedAt:    created.Add(time.Hour),
+		Roles:        []string{"admin", "support"},
+		Version:      3,
+	}))
+	deletedAt := created.Add(2 * time.Hour)
+	require.NoError(t, user_repository.Create(ctx, &UserRecord{
+		Id:        "deleted",
+		FirstName: "Gone",
+		Email:     "gone@club.com",
+		Country:   "SA",
+		CreatedAt: created,
+		UpdatedAt: deletedAt,
+		Version:   2,
+		DeletedAt: &deletedAt,
+	}))
+
+	svc := NewUserService(user_repository, NewRecordingPublisher(), WithLegacyTimestamps(false))
+
+	export := func(t *testing.T, req *pb.ExportUsersRequest) *exportStream {
+		stream := &exportStream{}
+		require.NoError(t, svc.ExportUsers(req, stream))
+		return stream
+	}
+
+	t.Run("Users In Batches", func(t *testing.T) {
+		stream := export(t, &pb.ExportUsersRequest{})
+		require.Len(t, stream.responses, 2)
+		require.Len(t, stream.responses[0].Users, exportBatchSize)
+
+		users := stream.users()
+		require.Len(t, users, exportBatchSize+3)
+		require.Equal(t, "cr7", users[0].Id)
+		require.Equal(t, "user-0000", users[1].Id)
+		require.Equal(t, []string{"admin", "support"}, users[0].Roles)
+		require.NotEmpty(t, users[0].Permissions)
+		require.Equal(t, created, users[0].CreatedAt.AsTime())
+	})
+
+	t.Run("Filter And Show Deleted", func(t *testing.T) {
+		stream := export(t, &pb.ExportUsersRequest{Filter: `country = "SA"`})
+		require.Len(t, stream.users(), 1)
+
+		stream = export(t, &pb.ExportUsersRequest{Filter: `country = "SA"`, ShowDeleted: true})
+		users := stream.users()
+		require.Len(t, users, 2)
+		require.Equal(t, "deleted", users[1].Id)
+		require.Equal(t, deletedAt, users[1].DeletedAt.AsTime())
+	})
+
+	t.Run("NDJSON", func(t *testing.T) {
+		stream := export(t, &pb.ExportUsersRequest{
+			Filter:   `country = "SA" OR nickname = "player1"`,
+			ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"id", "email", "permissions"}},
+			Format:   pb.ExportFormat_EXPORT_FORMAT_NDJSON,
+		})
+		require.Empty(t, stream.users())
+
+		var users []*pb.User
+		scanner := bufio.NewScanner(bytes.NewReader(stream.payload()))
+		for scanner.Scan() {
+			require.NotContains(t, scanner.Text(), "hash")
+			user := &pb.User{}
+			require.NoError(t, protojson.Unmarshal(scanner.Bytes(), user))
+			users = append(users, user)
+		}
+		require.Len(t, users, 2)
+		require.Equal(t, "cr7", users[0].Id)
+		require.Equal(t, "cristiano@ronaldo.com", users[0].Email)
+		require.NotEmpty(t, users[0].Permissions)
+		require.Empty(t, users[0].Roles)
+		require.Empty(t, users[0].FirstName)
+		require.Equal(t, "user-0001", users[1].Id)
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		stream := export(t, &pb.ExportUsersRequest{Filter: `id = "cr7"`, Format: pb.ExportFormat_EXPORT_FORMAT_CSV})
+		records, err := csv.NewReader(bytes.NewReader(stream.payload())).ReadAll()
+		require.NoError(t, err)
+		require.Equal(t, [][]string{
+			{"id", "first_name", "last_name", "nickname", "email", "country", "roles", "permissions", "version", "created_at", "updated_at", "deleted_at"},
+			{"cr7", "Cristiano", "Ronaldo, Jr", "CR7", "cristiano@ronaldo.com", "SA", "admin;support", strings.Join(svc.permissions([]string{"admin", "support"}), ";"), "3", "2025-03-01T10:00:00Z", "2025-03-01T11:00:00Z", ""},
+		}, records)
+
+		// the header is sent even without users
+		stream = export(t, &pb.ExportUsersRequest{
+			Filter:   `id = "nobody"`,
+			ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"email", "id"}},
+			Format:   pb.ExportFormat_EXPORT_FORMAT_CSV,
+		})
+		require.Equal(t, "email,id\n", string(stream.payload()))
+	})
+
+	t.Run("Chunks Hold Whole Rows", func(t *testing.T) {
+		stream := export(t, &pb.ExportUsersRequest{Format: pb.ExportFormat_EXPORT_FORMAT_NDJSON, ShowDeleted: true})
+		require.Greater(t, len(stream.responses), 1)
+
+		lines := 0
+		for _, response := range stream.responses {
+			require.True(t, bytes.HasSuffix(response.Chunk, []byte("\n")))
+			lines += bytes.Count(response.Chunk, []byte("\n"))
+		}
+		require.Equal(t, exportBatchSize+4, lines)
+	})
+
+	t.Run("Failed Send Stops The Export", func(t *testing.T) {
+		stream := &exportStream{failAfter: 1}
+		err := svc.ExportUsers(&pb.ExportUsersRequest{}, stream)
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		require.Len(t, stream.responses, 1)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		stream := &exportStream{ctx: cancelled}
+		err := svc.ExportUsers(&pb.ExportUsersRequest{}, stream)
+		require.Equal(t, codes.Canceled, status.Code(err))
+		require.Empty(t, stream.responses)
+	})
+
+	t.Run("Invalid Requests", func(t *testing.T) {
+		err := svc.ExportUsers(&pb.ExportUsersRequest{
+			Filter:   `country =`,
+			ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"password"}},
+			Format:   pb.ExportFormat(7),
+		}, &exportStream{})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+		require.ElementsMatch(t, []string{"filter", "read_mask", "format"}, fieldViolations(t, err))
+	})
+
+	t.Run("MongoDB Pages", func(t *testing.T) {
+		collection := testDatabase(t).Collection(UserCollection)
+		var documents []any
+		for i := range 2*exportBatchSize + 1 {
+			documents = append(documents, &UserRecord{Id: fmt.Sprintf("user-%04d", i), Email: fmt.Sprintf("player%d@club.com", i), CreatedAt: created})
+		}
+		_, err := collection.InsertMany(ctx, documents)
+		require.NoError(t, err)
+
+		var ids []string
+		err = NewMongoUserRepository(collection).Export(ctx, ListQuery{
+			Sort:   []SortField{{Field: "id"}},
+			Fields: []string{"email"},
+		}, func(user *UserRecord) error {
+			ids = append(ids, user.Id)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Len(t, ids, 2*exportBatchSize+1)
+		require.Equal(t, "user-0000", ids[0])
+		require.IsIncreasing(t, ids)
+	})
+
+	t.Run("Repository Errors", func(t *testing.T) {
+		failing := NewUserService(&failingExport{UserRepository: user_repository}, NewRecordingPublisher())
+		err := failing.ExportUsers(&pb.ExportUsersRequest{}, &exportStream{})
+		require.Equal(t, codes.Internal, status.Code(err))
+	})
+}
+
+// failingExport fails when the cursor breaks
+type failingExport struct {
+	UserRepository
+}
+
+func (repo *failingExport) Export(ctx context.Context, query ListQuery, fn func(*UserRecord) error) error {
+	return errors.New("cursor killed")
+}
@@ -0,0 +1,197 @@
+package grpc_user
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Filter is a condition on the stored users. ListUsers builds it from the
+// request, the MongoDB repository compiles it to a query and the in-memory one
+// matches it directly. A nil Filter matches every user.
+type Filter interface {
+	filter()
+}
+
+// And matches users that match all of its filters
+type And []Filter
+
+// Or matches users that match any of its filters
+type Or []Filter
+
+// Not matches users that don't match its filter
+type Not struct {
+	Filter Filter
+}
+
+type Operator int
+
+const (
+	OpEqual Operator = iota
+	OpNotEqual
+	OpLess
+	OpLessOrEqual
+	OpGreater
+	OpGreaterOrEqual
+	OpPrefix
+	OpSuffix
+	OpContains
+	OpIn
+)
+
+// Condition compares a stored field with Value, or with Values for OpIn
+type Condition struct {
+	Field      string
+	Op         Operator
+	Value      string
+	Values     []string
+	IgnoreCase bool
+}
+
+func (And) filter()       {}
+func (Or) filter()        {}
+func (Not) filter()       {}
+func (Condition) filter() {}
+
+// filterFields are the stored fields filters and order_by may use
+var filterFields = []string{"id", "first_name", "last_name", "nickname", "email", "country", "created_at", "updated_at", "deleted_at"}
+
+// timeFields are the filterFields holding times, their values are time keys
+var timeFields = []string{"created_at", "updated_at", "deleted_at"}
+
+// SortField is one key of the list order
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// defaultSort lists the oldest users first
+var defaultSort = []SortField{{Field: "created_at"}, {Field: "id"}}
+
+// matchFilter reports whether the user matches the filter
+func matchFilter(user *UserRecord, filter Filter) bool {
+	switch filter := filter.(type) {
+	case nil:
+		return true
+	case And:
+		for _, f := range filter {
+			if !matchFilter(user, f) {
+				return false
+			}
+		}
+		return true
+	case Or:
+		for _, f := range filter {
+			if matchFilter(user, f) {
+				return true
+			}
+		}
+		return false
+	case Not:
+		return !matchFilter(user, filter.Filter)
+	case Condition:
+		return matchCondition(user, filter)
+	default:
+		panic(fmt.Sprintf("unknown filter %T", filter))
+	}
+}
+
+func matchCondition(user *UserRecord, condition Condition) bool {
+	value := fieldValue(user, condition.Field)
+	operand := condition.Value
+	values := condition.Values
+	if condition.IgnoreCase {
+		value = strings.ToLower(value)
+		operand = strings.ToLower(operand)
+		values = make([]string, len(condition.Values))
+		for i, v := range condition.Values {
+			values[i] = strings.ToLower(v)
+		}
+	}
+
+	// unset times are missing in MongoDB, where no ordered comparison matches them
+	if value == "" && slices.Contains(timeFields, condition.Field) {
+		switch condition.Op {
+		case OpLess, OpLessOrEqual, OpGreater, OpGreaterOrEqual:
+			return false
+		}
+	}
+
+	switch condition.Op {
+	case OpEqual:
+		return value == operand
+	case OpNotEqual:
+		return value != operand
+	case OpLess:
+		return value < operand
+	case OpLessOrEqual:
+		return value <= operand
+	case OpGreater:
+		return value > operand
+	case OpGreaterOrEqual:
+		return value >= operand
+	case OpPrefix:
+		return strings.HasPrefix(value, operand)
+	case OpSuffix:
+		return strings.HasSuffix(value, operand)
+	case OpContains:
+		return strings.Contains(value, operand)
+	case OpIn:
+		return slices.Contains(values, value)
+	default:
+		panic(fmt.Sprintf("unknown operator %d", condition.Op))
+	}
+}
+
+// fieldValue returns a field of filterFields by its stored name
+func fieldValue(user *UserRecord, field string) string {
+	switch field {
+	case "id":
+		return user.Id
+	case "first_name":
+		return user.FirstName
+	case "last_name":
+		return user.LastName
+	case "nickname":
+		return user.Nickname
+	case "email":
+		return user.Email
+	case "country":
+		return user.Country
+	case "created_at":
+		return timeKey(user.CreatedAt)
+	case "updated_at":
+		return timeKey(user.UpdatedAt)
+	case "deleted_at":
+		if user.DeletedAt == nil {
+			return ""
+		}
+		return timeKey(*user.DeletedAt)
+	default:
+		panic(fmt.Sprintf("field %q can't be filtered", field))
+	}
+}
+
+// sortKey returns the values of the user for each sort field
+func sortKey(user *UserRecord, sort []SortField) []string {
+	key := make([]string, len(sort))
+	for i, field := range sort {
+		key[i] = fieldValue(user, field.Field)
+	}
+	return key
+}
+
+// compareKeys orders two sort keys like the MongoDB sort does
+func compareKeys(a []string, b []string, sort []SortField) int {
+	for i, field := range sort {
+		c := cmp.Compare(a[i], b[i])
+		if field.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
@@ -0,0 +1,194 @@
+package grpc_user
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// mongoFilter compiles a Filter to a MongoDB query
+func mongoFilter(filter Filter) bson.M {
+	switch filter := filter.(type) {
+	case nil:
+		return bson.M{}
+	case And:
+		return bson.M{"$and": mongoFilters(filter)}
+	case Or:
+		return bson.M{"$or": mongoFilters(filter)}
+	case Not:
+		return bson.M{"$nor": bson.A{mongoFilter(filter.Filter)}}
+	case Condition:
+		return bson.M{filter.Field: mongoCondition(filter)}
+	default:
+		panic(fmt.Sprintf("unknown filter %T", filter))
+	}
+}
+
+func mongoFilters(filters []Filter) bson.A {
+	compiled := make(bson.A, len(filters))
+	for i, filter := range filters {
+		compiled[i] = mongoFilter(filter)
+	}
+	return compiled
+}
+
+func mongoCondition(condition Condition) any {
+	value := regexp.QuoteMeta(condition.Value)
+	if slices.Contains(timeFields, condition.Field) {
+		return mongoTimeCondition(condition)
+	}
+
+	switch {
+	case condition.Op == OpEqual && condition.Value == "":
+		// fields stored with omitempty are missing when empty
+		return bson.M{"$in": bson.A{nil, ""}}
+	case condition.Op == OpNotEqual && condition.Value == "":
+		return bson.M{"$nin": bson.A{nil, ""}}
+	}
+
+	switch condition.Op {
+	case OpEqual:
+		if condition.IgnoreCase {
+			return caseRegex("^"+value+"$", true)
+		}
+		return condition.Value
+	case OpNotEqual:
+		if condition.IgnoreCase {
+			return bson.M{"$not": caseRegex("^"+value+"$", true)}
+		}
+		return bson.M{"$ne": condition.Value}
+	case OpLess:
+		return bson.M{"$lt": condition.Value}
+	case OpLessOrEqual:
+		return bson.M{"$lte": condition.Value}
+	case OpGreater:
+		return bson.M{"$gt": condition.Value}
+	case OpGreaterOrEqual:
+		return bson.M{"$gte": condition.Value}
+	case OpPrefix:
+		// a case sensitive prefix regex can still use the index
+		return caseRegex("^"+value, condition.IgnoreCase)
+	case OpSuffix:
+		return caseRegex(value+"$", condition.IgnoreCase)
+	case OpContains:
+		return caseRegex(value, condition.IgnoreCase)
+	case OpIn:
+		if !condition.IgnoreCase {
+			return bson.M{"$in": condition.Values}
+		}
+		values := make(bson.A, len(condition.Values))
+		for i, v := range condition.Values {
+			values[i] = caseRegex("^"+regexp.QuoteMeta(v)+"$", true)
+		}
+		return bson.M{"$in": values}
+	default:
+		panic(fmt.Sprintf("unknown operator %d", condition.Op))
+	}
+}
+
+// mongoTimeCondition compares BSON dates, the time keys of the condition are
+// converted back to times
+func mongoTimeCondition(condition Condition) any {
+	switch condition.Op {
+	case OpEqual:
+		if condition.Value == "" {
+			return bson.M{"$in": bson.A{nil, ""}}
+		}
+		return mongoValue(condition.Field, condition.Value)
+	case OpNotEqual:
+		if condition.Value == "" {
+			return bson.M{"$nin": bson.A{nil, ""}}
+		}
+		return bson.M{"$ne": mongoValue(condition.Field, condition.Value)}
+	case OpLess:
+		return bson.M{"$lt": mongoValue(condition.Field, condition.Value)}
+	case OpLessOrEqual:
+		return bson.M{"$lte": mongoValue(condition.Field, condition.Value)}
+	case OpGreater:
+		return bson.M{"$gt": mongoValue(condition.Field, condition.Value)}
+	case OpGreaterOrEqual:
+		return bson.M{"$gte": mongoValue(condition.Field, condition.Value)}
+	case OpIn:
+		values := make(bson.A, len(condition.Values))
+		for i, v := range condition.Values {
+			values[i] = mongoValue(condition.Field, v)
+		}
+		return bson.M{"$in": values}
+	default:
+		// text matching has no meaning on dates
+		panic(fmt.Sprintf("operator %d on time field %s", condition.Op, condition.Field))
+	}
+}
+
+// mongoValue converts a filter or cursor value to its stored form, time keys
+// are stored as BSON dates and an empty time key is a missing field
+func mongoValue(field string, value string) any {
+	if !slices.Contains(timeFields, field) {
+		return value
+	}
+	if value == "" {
+		return nil
+	}
+	t, err := parseTimeKey(value)
+	if err != nil {
+		// filters and cursors only ever hold valid time keys
+		panic(fmt.Sprintf("invalid time key %q for %s", value, field))
+	}
+	return t
+}
+
+func caseRegex(pattern string, ignoreCase bool) primitive.Regex {
+	if ignoreCase {
+		return primitive.Regex{Pattern: pattern, Options: "i"}
+	}
+	return primitive.Regex{Pattern: pattern}
+}
+
+func mongoSort(sort []SortField) bson.D {
+	order := make(bson.D, len(sort))
+	for i, field := range sort {
+		direction := 1
+		if field.Descending {
+			direction = -1
+		}
+		order[i] = bson.E{Key: field.Field, Value: direction}
+	}
+	return order
+}
+
+// mongoAfter matches the users that sort after the cursor:
+// k1 > v1, or k1 = v1 and k2 > v2, and so on, with < for descending keys.
+// Unset times are null, which MongoDB sorts below every date and $gt and $lt
+// never match, so they are compared the way compareKeys compares "".
+func mongoAfter(sort []SortField, cursor *Cursor) bson.M {
+	var after bson.A
+	for i, field := range sort {
+		condition := bson.M{}
+		for j := 0; j < i; j++ {
+			condition[sort[j].Field] = mongoValue(sort[j].Field, cursor.Values[j])
+		}
+
+		value := mongoValue(field.Field, cursor.Values[i])
+		switch {
+		case value == nil && field.Descending:
+			// nothing sorts after null, only the next keys can
+			continue
+		case value == nil:
+			condition[field.Field] = bson.M{"$ne": nil}
+		case field.Descending && slices.Contains(timeFields, field.Field):
+			condition["$or"] = bson.A{
+				bson.M{field.Field: bson.M{"$lt": value}},
+				bson.M{field.Field: nil},
+			}
+		case field.Descending:
+			condition[field.Field] = bson.M{"$lt": value}
+		default:
+			condition[field.Field] = bson.M{"$gt": value}
+		}
+		after = append(after, condition)
+	}
+	return bson.M{"$or": after}
+}
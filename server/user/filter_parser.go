@@ -0,0 +1,352 @@
+package grpc_user
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// parseFilter parses an AIP-160 style filter expression into a Filter, e.g.
+//
+//	country = "PT" AND created_at > "2025-01-01" AND NOT nickname:"bot*"
+//
+// Terms next to each other are ANDed and OR binds tighter than AND. ":" matches
+// text ignoring case, with "*" as a wildcard at the start or end of the value.
+// Fields are the User fields in filterFields, times are RFC 3339 or dates.
+func parseFilter(expression string) (Filter, error) {
+	tokens, err := lexFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	filter, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.kind != tokenEOF {
+		return nil, unexpected(token)
+	}
+	return filter, nil
+}
+
+// filterError points at the token of the expression that is wrong, Pos counts
+// characters from 1
+type filterError struct {
+	Pos     int
+	Message string
+}
+
+func (err *filterError) Error() string {
+	return fmt.Sprintf("%s at position %d", err.Message, err.Pos)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenComparator
+	tokenLParen
+	tokenRParen
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenMinus
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func unexpected(token filterToken) error {
+	if token.kind == tokenEOF {
+		return &filterError{Pos: token.pos, Message: "unexpected end of filter"}
+	}
+	return &filterError{Pos: token.pos, Message: fmt.Sprintf("unexpected %q", token.text)}
+}
+
+// comparators longest first, so "<=" isn't read as "<"
+var comparators = []string{"<=", ">=", "!=", "=", "<", ">", ":"}
+
+func lexFilter(input string) ([]filterToken, error) {
+	runes := []rune(input)
+
+	var tokens []filterToken
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := i + 1
+
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			i++
+		case r == '(':
+			tokens = append(tokens, filterToken{kind: tokenLParen, text: "(", pos: pos})
+			i++
+		case r == ')':
+			tokens = append(tokens, filterToken{kind: tokenRParen, text: ")", pos: pos})
+			i++
+		case r == '"' || r == '\'':
+			var text strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				text.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, &filterError{Pos: pos, Message: "unterminated string"}
+			}
+			tokens = append(tokens, filterToken{kind: tokenString, text: text.String(), pos: pos})
+			i++
+		case strings.ContainsRune("=!<>:", r):
+			rest := string(runes[i:])
+			index := slices.IndexFunc(comparators, func(c string) bool { return strings.HasPrefix(rest, c) })
+			if index < 0 {
+				return nil, &filterError{Pos: pos, Message: fmt.Sprintf("unexpected %q", string(r))}
+			}
+			tokens = append(tokens, filterToken{kind: tokenComparator, text: comparators[index], pos: pos})
+			i += len(comparators[index])
+		case r == '-' && i+1 < len(runes) && !isFilterSpace(runes[i+1]):
+			tokens = append(tokens, filterToken{kind: tokenMinus, text: "-", pos: pos})
+			i++
+		default:
+			start := i
+			for i < len(runes) && !isFilterSpace(runes[i]) && !strings.ContainsRune("()=!<>:\"'", runes[i]) {
+				i++
+			}
+			word := string(runes[start:i])
+
+			kind := tokenWord
+			switch word {
+			case "AND":
+				kind = tokenAnd
+			case "OR":
+				kind = tokenOr
+			case "NOT":
+				kind = tokenNot
+			}
+			tokens = append(tokens, filterToken{kind: kind, text: word, pos: pos})
+		}
+	}
+
+	return append(tokens, filterToken{kind: tokenEOF, pos: len(runes) + 1}), nil
+}
+
+func isFilterSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+// expression = sequence { "AND" sequence }
+func (p *filterParser) expression() (Filter, error) {
+	var filters And
+	for {
+		filter, err := p.sequence()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+
+		if p.peek().kind != tokenAnd {
+			break
+		}
+		p.next()
+	}
+	return flattenAnd(filters), nil
+}
+
+// sequence = factor { factor }, the factors are ANDed
+func (p *filterParser) sequence() (Filter, error) {
+	var filters And
+	for {
+		filter, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+
+		switch p.peek().kind {
+		case tokenEOF, tokenRParen, tokenAnd:
+			return flattenAnd(filters), nil
+		}
+	}
+}
+
+// factor = term { "OR" term }
+func (p *filterParser) factor() (Filter, error) {
+	var filters Or
+	for {
+		filter, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+
+		if p.peek().kind != tokenOr {
+			break
+		}
+		p.next()
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return filters, nil
+}
+
+// term = [ "NOT" | "-" ] simple
+func (p *filterParser) term() (Filter, error) {
+	if kind := p.peek().kind; kind == tokenNot || kind == tokenMinus {
+		p.next()
+		filter, err := p.simple()
+		if err != nil {
+			return nil, err
+		}
+		return Not{Filter: filter}, nil
+	}
+	return p.simple()
+}
+
+// simple = restriction | "(" expression ")"
+func (p *filterParser) simple() (Filter, error) {
+	if p.peek().kind != tokenLParen {
+		return p.restriction()
+	}
+
+	p.next()
+	filter, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.next(); token.kind != tokenRParen {
+		if token.kind == tokenEOF {
+			return nil, &filterError{Pos: token.pos, Message: "missing \")\""}
+		}
+		return nil, unexpected(token)
+	}
+	return filter, nil
+}
+
+// restriction = field comparator value
+func (p *filterParser) restriction() (Filter, error) {
+	field := p.next()
+	if field.kind != tokenWord {
+		return nil, unexpected(field)
+	}
+	if !slices.Contains(filterFields, field.text) {
+		return nil, &filterError{Pos: field.pos, Message: fmt.Sprintf("unknown field %q", field.text)}
+	}
+
+	comparator := p.next()
+	if comparator.kind != tokenComparator {
+		if comparator.kind == tokenEOF {
+			return nil, &filterError{Pos: comparator.pos, Message: fmt.Sprintf("missing comparison for %q", field.text)}
+		}
+		return nil, &filterError{Pos: comparator.pos, Message: fmt.Sprintf("expected a comparison after %q, got %q", field.text, comparator.text)}
+	}
+
+	value := p.next()
+	if value.kind != tokenWord && value.kind != tokenString {
+		return nil, unexpected(value)
+	}
+
+	return restrictionCondition(field, comparator, value)
+}
+
+// restrictionCondition checks the value against the field type
+func restrictionCondition(field filterToken, comparator filterToken, value filterToken) (Filter, error) {
+	condition := Condition{Field: field.text, Value: value.text}
+
+	// field:* only checks the field is set, which works for times too
+	if slices.Contains(timeFields, field.text) && !(comparator.text == ":" && value.text == "*") {
+		if comparator.text == ":" {
+			return nil, &filterError{Pos: comparator.pos, Message: fmt.Sprintf("%q can't be used with %s, compare it with = < <= > >=", ":", field.text)}
+		}
+		t, err := parseFilterTime(value.text)
+		if err != nil {
+			return nil, &filterError{Pos: value.pos, Message: fmt.Sprintf("invalid time %q, use RFC 3339 or YYYY-MM-DD", value.text)}
+		}
+		condition.Value = timeKey(t)
+	}
+	if field.text == "email" {
+		condition.Value = normalizeEmail(condition.Value)
+	}
+
+	switch comparator.text {
+	case "=":
+		condition.Op = OpEqual
+	case "!=":
+		condition.Op = OpNotEqual
+	case "<":
+		condition.Op = OpLess
+	case "<=":
+		condition.Op = OpLessOrEqual
+	case ">":
+		condition.Op = OpGreater
+	case ">=":
+		condition.Op = OpGreaterOrEqual
+	case ":":
+		return hasCondition(condition), nil
+	}
+	return condition, nil
+}
+
+// hasCondition turns field:"value" into a case insensitive match, "*" alone
+// matches any non empty value
+func hasCondition(condition Condition) Filter {
+	value := condition.Value
+	condition.IgnoreCase = true
+
+	prefix := strings.HasSuffix(value, "*")
+	suffix := strings.HasPrefix(value, "*")
+	condition.Value = strings.TrimSuffix(strings.TrimPrefix(value, "*"), "*")
+
+	switch {
+	case condition.Value == "":
+		return Condition{Field: condition.Field, Op: OpNotEqual, Value: ""}
+	case prefix && suffix:
+		condition.Op = OpContains
+	case prefix:
+		condition.Op = OpPrefix
+	case suffix:
+		condition.Op = OpSuffix
+	default:
+		condition.Op = OpEqual
+	}
+	return condition
+}
+
+func parseFilterTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+func flattenAnd(filters And) Filter {
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return filters
+}
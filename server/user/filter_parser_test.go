@@ -0,0 +1,106 @@
+package grpc_user
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+)
+
+func TestFilterParser(t *testing.T) {
+	t.Run("Precedence", func(t *testing.T) {
+		filter, err := parseFilter(`country = "PT" OR country = "BR" last_name:ronaldo AND NOT (nickname = R9 OR -email:"*.br")`)
+		require.NoError(t, err)
+		require.Equal(t, And{
+			And{
+				Or{
+					Condition{Field: "country", Op: OpEqual, Value: "PT"},
+					Condition{Field: "country", Op: OpEqual, Value: "BR"},
+				},
+				Condition{Field: "last_name", Op: OpEqual, Value: "ronaldo", IgnoreCase: true},
+			},
+			Not{Filter: Or{
+				Condition{Field: "nickname", Op: OpEqual, Value: "R9"},
+				Not{Filter: Condition{Field: "email", Op: OpSuffix, Value: ".br", IgnoreCase: true}},
+			}},
+		}, filter)
+	})
+
+	t.Run("Wildcards", func(t *testing.T) {
+		tests := map[string]Condition{
+			`nickname:"bot*"`:      {Field: "nickname", Op: OpPrefix, Value: "bot", IgnoreCase: true},
+			`nickname:"*bot"`:      {Field: "nickname", Op: OpSuffix, Value: "bot", IgnoreCase: true},
+			`nickname:"*bot*"`:     {Field: "nickname", Op: OpContains, Value: "bot", IgnoreCase: true},
+			`nickname:*`:           {Field: "nickname", Op: OpNotEqual, Value: ""},
+			`nickname != 'a\'b'`:   {Field: "nickname", Op: OpNotEqual, Value: "a'b"},
+			`email = Mo@Salah.com`: {Field: "email", Op: OpEqual, Value: "mo@salah.com"},
+		}
+		for expression, expected := range tests {
+			filter, err := parseFilter(expression)
+			require.NoError(t, err, expression)
+			require.Equal(t, expected, filter, expression)
+		}
+	})
+
+	t.Run("Times", func(t *testing.T) {
+		filter, err := parseFilter(`created_at >= 2025-01-01 updated_at < "2025-03-01T10:00:00+01:00"`)
+		require.NoError(t, err)
+		require.Equal(t, And{
+			Condition{Field: "created_at", Op: OpGreaterOrEqual, Value: "2025-01-01T00:00:00.000Z"},
+			Condition{Field: "updated_at", Op: OpLess, Value: "2025-03-01T09:00:00.000Z"},
+		}, filter)
+	})
+
+	t.Run("Errors Point At The Token", func(t *testing.T) {
+		tests := map[string]string{
+			`password = "x"`:                      `unknown field "password" at position 1`,
+			`country = "PT" AND`:                  `unexpected end of filter at position 19`,
+			`country "PT"`:                        `expected a comparison after "country", got "PT" at position 9`,
+			`country = "PT`:                       `unterminated string at position 11`,
+			`(country = PT`:                       `missing ")" at position 14`,
+			`country = PT)`:                       `unexpected ")" at position 13`,
+			`created_at > "yesterday"`:            `invalid time "yesterday", use RFC 3339 or YYYY-MM-DD at position 14`,
+			`created_at:2025`:                     `":" can't be used with created_at, compare it with = < <= > >= at position 11`,
+			`country = PT AND email =! "a@b.com"`: `unexpected "!" at position 25`,
+		}
+		for expression, message := range tests {
+			_, err := parseFilter(expression)
+			require.EqualError(t, err, message, expression)
+		}
+	})
+
+	t.Run("List Users", func(t *testing.T) {
+		ctx := context.Background()
+
+		user_repository := NewInMemoryUserRepository()
+		for _, user := range []*UserRecord{
+			{Id: "a", LastName: "Ronaldo", Nickname: "CR7", Email: "cristiano@ronaldo.com", Country: "PT", CreatedAt: testTime("2025-01-10T10:00:00Z")},
+			{Id: "b", LastName: "Bot", Nickname: "BotPT", Email: "bot@example.com", Country: "PT", CreatedAt: testTime("2025-02-10T10:00:00Z")},
+			{Id: "c", LastName: "Silva", Nickname: "Silva", Email: "silva@example.com", Country: "PT", CreatedAt: testTime("2024-12-10T10:00:00Z")},
+			{Id: "d", LastName: "Salah", Nickname: "MoSalah", Email: "mo@salah.com", Country: "EG", CreatedAt: testTime("2025-04-10T10:00:00Z")},
+		} {
+			require.NoError(t, user_repository.Create(ctx, user))
+		}
+		svc := NewUserService(user_repository, nil)
+
+		resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{Filter: `country = "PT" AND created_at > "2025-01-01" AND NOT nickname:"bot*"`})
+		require.NoError(t, err)
+		require.Len(t, resp.Users, 1)
+		require.Equal(t, "a", resp.Users[0].Id)
+		require.Equal(t, int32(1), resp.TotalCount)
+
+		// the filter is ANDed with the other fields
+		resp, err = svc.ListUsers(ctx, &pb.ListUsersRequest{Countries: []string{"EG"}, Filter: `last_name:s*`})
+		require.NoError(t, err)
+		require.Len(t, resp.Users, 1)
+		require.Equal(t, "d", resp.Users[0].Id)
+
+		_, err = svc.ListUsers(ctx, &pb.ListUsersRequest{Filter: `country = "PT" AND age > 30`})
+		require.Equal(t, []string{"filter"}, fieldViolations(t, err))
+		badRequest := status.Convert(err).Details()[0].(*errdetails.BadRequest)
+		require.Equal(t, `unknown field "age" at position 20`, badRequest.FieldViolations[0].Description)
+	})
+}
@@ -0,0 +1,156 @@
+package grpc_user
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFilter(t *testing.T) {
+	user := &UserRecord{
+		Id:        "86f9f466-851a-4b93-af21-d5f52ac91006",
+		FirstName: "Cristiano",
+		LastName:  "Ronaldo",
+		Email:     "cristiano@ronaldo.com",
+		Country:   "PT",
+		CreatedAt: testTime("2025-03-22T18:37:00Z"),
+	}
+
+	t.Run("Match", func(t *testing.T) {
+		tests := map[string]struct {
+			filter  Filter
+			matches bool
+		}{
+			"Nil":              {nil, true},
+			"Equal":            {Condition{Field: "country", Op: OpEqual, Value: "PT"}, true},
+			"Equal Case":       {Condition{Field: "last_name", Op: OpEqual, Value: "ronaldo"}, false},
+			"Equal Ignore":     {Condition{Field: "last_name", Op: OpEqual, Value: "ronaldo", IgnoreCase: true}, true},
+			"Not Equal":        {Condition{Field: "country", Op: OpNotEqual, Value: "PT"}, false},
+			"Prefix":           {Condition{Field: "first_name", Op: OpPrefix, Value: "Cris"}, true},
+			"Prefix Ignore":    {Condition{Field: "first_name", Op: OpPrefix, Value: "cris", IgnoreCase: true}, true},
+			"Suffix":           {Condition{Field: "email", Op: OpSuffix, Value: "@ronaldo.com"}, true},
+			"Contains Ignore":  {Condition{Field: "last_name", Op: OpContains, Value: "NALD", IgnoreCase: true}, true},
+			"In":               {Condition{Field: "country", Op: OpIn, Values: []string{"ES", "PT"}}, true},
+			"Not In":           {Condition{Field: "country", Op: OpIn, Values: []string{"ES", "IT"}}, false},
+			"Greater Or Equal": {Condition{Field: "created_at", Op: OpGreaterOrEqual, Value: "2025-03-22T18:37:00.000Z"}, true},
+			"Less":             {Condition{Field: "created_at", Op: OpLess, Value: "2025-03-22T18:37:00.000Z"}, false},
+			"And":              {And{Condition{Field: "country", Op: OpEqual, Value: "PT"}, Condition{Field: "last_name", Op: OpEqual, Value: "Messi"}}, false},
+			"Or":               {Or{Condition{Field: "country", Op: OpEqual, Value: "AR"}, Condition{Field: "last_name", Op: OpEqual, Value: "Ronaldo"}}, true},
+			"Not":              {Not{Filter: Condition{Field: "country", Op: OpEqual, Value: "AR"}}, true},
+			"Empty Or":         {Or{}, false},
+		}
+
+		for name, test := range tests {
+			t.Run(name, func(t *testing.T) {
+				require.Equal(t, test.matches, matchFilter(user, test.filter))
+			})
+		}
+	})
+
+	t.Run("Compile To MongoDB", func(t *testing.T) {
+		filter := And{
+			Condition{Field: "country", Op: OpIn, Values: []string{"ES", "PT"}},
+			Condition{Field: "first_name", Op: OpPrefix, Value: "Cris.", IgnoreCase: true},
+			Not{Filter: Condition{Field: "email", Op: OpSuffix, Value: "@ronaldo.com"}},
+			Condition{Field: "created_at", Op: OpGreaterOrEqual, Value: "2025-03-22T18:37:00.000Z"},
+			Condition{Field: "nickname", Op: OpContains, Value: "bot", IgnoreCase: true},
+		}
+
+		require.Equal(t, bson.M{"$and": bson.A{
+			bson.M{"country": bson.M{"$in": []string{"ES", "PT"}}},
+			bson.M{"first_name": primitive.Regex{Pattern: `^Cris\.`, Options: "i"}},
+			bson.M{"$nor": bson.A{bson.M{"email": primitive.Regex{Pattern: `@ronaldo\.com$`}}}},
+			bson.M{"created_at": bson.M{"$gte": testTime("2025-03-22T18:37:00Z")}},
+			bson.M{"nickname": primitive.Regex{Pattern: "bot", Options: "i"}},
+		}}, mongoFilter(filter))
+		require.Equal(t, bson.M{}, mongoFilter(nil))
+	})
+
+	t.Run("Keyset After Cursor", func(t *testing.T) {
+		sort := []SortField{{Field: "last_name", Descending: true}, {Field: "id"}}
+		require.Equal(t, bson.M{"$or": bson.A{
+			bson.M{"last_name": bson.M{"$lt": "Ronaldo"}},
+			bson.M{"last_name": "Ronaldo", "id": bson.M{"$gt": "86f9"}},
+		}}, mongoAfter(sort, &Cursor{Values: []string{"Ronaldo", "86f9"}}))
+	})
+
+	t.Run("Keyset After Unset Time", func(t *testing.T) {
+		// the cursor user isn't deleted, deleted users still come after it
+		cursor := &Cursor{Values: []string{"", "86f9"}}
+		require.Equal(t, bson.M{"$or": bson.A{
+			bson.M{"deleted_at": bson.M{"$ne": nil}},
+			bson.M{"deleted_at": nil, "id": bson.M{"$gt": "86f9"}},
+		}}, mongoAfter([]SortField{{Field: "deleted_at"}, {Field: "id"}}, cursor))
+
+		require.Equal(t, bson.M{"$or": bson.A{
+			bson.M{"deleted_at": nil, "id": bson.M{"$gt": "86f9"}},
+		}}, mongoAfter([]SortField{{Field: "deleted_at", Descending: true}, {Field: "id"}}, cursor))
+
+		// unset times sort last in descending order
+		deletedAt := "2025-03-22T18:37:00.000Z"
+		require.Equal(t, bson.M{"$or": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"deleted_at": bson.M{"$lt": testTime("2025-03-22T18:37:00Z")}},
+				bson.M{"deleted_at": nil},
+			}},
+			bson.M{"deleted_at": testTime("2025-03-22T18:37:00Z"), "id": bson.M{"$gt": "86f9"}},
+		}}, mongoAfter([]SortField{{Field: "deleted_at", Descending: true}, {Field: "id"}}, &Cursor{Values: []string{deletedAt, "86f9"}}))
+	})
+
+	t.Run("Unset Times Match Like MongoDB", func(t *testing.T) {
+		deletedAt := testTime("2025-03-24T08:00:00Z")
+		users := []*UserRecord{
+			{Id: "a", Email: "cristiano@ronaldo.com", CreatedAt: testTime("2025-03-22T18:37:00Z")},
+			{Id: "b", Email: "mo@salah.com", CreatedAt: testTime("2025-03-22T18:37:00Z"), DeletedAt: &deletedAt},
+		}
+		filters := map[string]struct {
+			filter Filter
+			ids    []string
+		}{
+			"Less":             {Condition{Field: "deleted_at", Op: OpLess, Value: "2030-01-01T00:00:00.000Z"}, []string{"b"}},
+			"Less Or Equal":    {Condition{Field: "deleted_at", Op: OpLessOrEqual, Value: "2030-01-01T00:00:00.000Z"}, []string{"b"}},
+			"Greater":          {Condition{Field: "deleted_at", Op: OpGreater, Value: "2020-01-01T00:00:00.000Z"}, []string{"b"}},
+			"Greater Or Equal": {Condition{Field: "deleted_at", Op: OpGreaterOrEqual, Value: "2020-01-01T00:00:00.000Z"}, []string{"b"}},
+			"Not Less":         {Not{Filter: Condition{Field: "deleted_at", Op: OpLess, Value: "2030-01-01T00:00:00.000Z"}}, []string{"a"}},
+			"Unset":            {Condition{Field: "deleted_at", Op: OpEqual, Value: ""}, []string{"a"}},
+			"Set":              {Condition{Field: "deleted_at", Op: OpNotEqual, Value: ""}, []string{"b"}},
+		}
+
+		matching := func(filter Filter) []string {
+			var ids []string
+			for _, user := range users {
+				if matchFilter(user, filter) {
+					ids = append(ids, user.Id)
+				}
+			}
+			return ids
+		}
+		for name, test := range filters {
+			require.Equal(t, test.ids, matching(test.filter), name)
+		}
+
+		ctx := context.Background()
+		collection := testDatabase(t).Collection(UserCollection)
+		for _, user := range users {
+			_, err := collection.InsertOne(ctx, user)
+			require.NoError(t, err)
+		}
+		for name, test := range filters {
+			cursor, err := collection.Find(ctx, mongoFilter(test.filter))
+			require.NoError(t, err)
+			var found []*UserRecord
+			require.NoError(t, cursor.All(ctx, &found))
+
+			var ids []string
+			for _, user := range found {
+				ids = append(ids, user.Id)
+			}
+			slices.Sort(ids)
+			require.Equal(t, matching(test.filter), ids, name)
+		}
+	})
+}
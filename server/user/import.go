@@ -0,0 +1,323 @@
+package grpc_user
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+const (
+	// importBatchSize is how many rows are checked and written together
+	importBatchSize = 100
+	// maxImportErrors bounds the row errors returned, failed still counts all
+	maxImportErrors = 1000
+	// maxImportLine bounds an NDJSON line and a CSV row, quoted newlines included
+	maxImportLine = 64 * 1024
+)
+
+// importRow is a row of the payload, Err is set when it can't be parsed
+type importRow struct {
+	Line int
+	User *pb.CreateUserRequest
+	Err  error
+}
+
+// importRows reads the rows of a payload, next returns io.EOF after the last
+type importRows interface {
+	next() (importRow, error)
+}
+
+// ImportUsers creates the users of a CSV or NDJSON payload sent in chunks, each
+// row is checked like in CreateUser and rows are written importBatchSize at a
+// time. Rows with an email already imported or taken are skipped. Users of the
+// batches written before a stream error stay created.
+func (svc *UserService) ImportUsers(stream pb.UserService_ImportUsersServer) error {
+	first, err := stream.Recv()
+	if err == io.EOF {
+		first = &pb.ImportUsersRequest{}
+	} else if err != nil {
+		return err
+	}
+
+	var v violations
+	if first.Format == pb.ImportFormat_IMPORT_FORMAT_UNSPECIFIED {
+		v.add("format", "must be IMPORT_FORMAT_CSV or IMPORT_FORMAT_NDJSON")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	payload := &chunkReader{stream: stream, chunk: first.Chunk}
+	var rows importRows
+	switch first.Format {
+	case pb.ImportFormat_IMPORT_FORMAT_CSV:
+		rows, err = newCSVRows(payload)
+		if err != nil {
+			return importError(err)
+		}
+	case pb.ImportFormat_IMPORT_FORMAT_NDJSON:
+		rows = newNDJSONRows(payload)
+	}
+
+	imp := &userImport{
+		service:   svc,
+		response:  &pb.ImportUsersResponse{DryRun: first.DryRun},
+		emails:    make(map[string]bool),
+		nicknames: make(map[string]bool),
+	}
+	var batch []importRow
+	for {
+		row, err := rows.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return importError(err)
+		}
+
+		imp.response.Rows++
+		if row.Err != nil {
+			imp.fail(row.Line, row.Err)
+			continue
+		}
+
+		batch = append(batch, row)
+		if len(batch) == importBatchSize {
+			if err := imp.write(stream.Context(), batch); err != nil {
+				return err
+			}
+			batch = nil
+		}
+	}
+	if err := imp.write(stream.Context(), batch); err != nil {
+		return err
+	}
+
+	log.Printf("Users Imported:  %d of %d", imp.response.Imported, imp.response.Rows)
+
+	return stream.SendAndClose(imp.response)
+}
+
+// importError turns a payload read error into a status
+func importError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var v violations
+	switch {
+	case errors.Is(err, bufio.ErrTooLong):
+		v.add("chunk", "lines and CSV rows can't be longer than %d bytes", maxImportLine)
+	default:
+		v.add("chunk", "%v", err)
+	}
+	return v.err()
+}
+
+// userImport is the progress of one ImportUsers call
+type userImport struct {
+	service  *UserService
+	response *pb.ImportUsersResponse
+	// emails and nicknames of the rows imported so far, a dry run writes
+	// nothing so the repository can't tell
+	emails    map[string]bool
+	nicknames map[string]bool
+}
+
+// write checks and creates a batch of rows, or only checks them in a dry run
+func (imp *userImport) write(ctx context.Context, rows []importRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	reqs := make([]*pb.CreateUserRequest, len(rows))
+	errs := make([]error, len(rows))
+	for i, row := range rows {
+		reqs[i] = row.User
+		switch {
+		case imp.emails[normalizeEmail(row.User.Email)]:
+			errs[i] = &DuplicateError{Field: "email"}
+		case row.User.Nickname != "" && imp.nicknames[row.User.Nickname]:
+			errs[i] = &DuplicateError{Field: "nickname"}
+		}
+	}
+
+	if err := imp.service.checkBatch(ctx, reqs, errs); err != nil {
+		return status.Errorf(codes.Internal, "Failed to check users: %v", err)
+	}
+	if !imp.response.DryRun {
+		if _, err := imp.service.createUsers(ctx, reqs, errs); err != nil {
+			return err
+		}
+	}
+
+	for i, row := range rows {
+		var duplicate *DuplicateError
+		switch {
+		case errs[i] == nil:
+			imp.response.Imported++
+			imp.emails[normalizeEmail(row.User.Email)] = true
+			if row.User.Nickname != "" {
+				imp.nicknames[row.User.Nickname] = true
+			}
+		case errors.As(errs[i], &duplicate) && duplicate.Field == "email":
+			imp.response.Duplicates++
+		default:
+			imp.fail(row.Line, errs[i])
+		}
+	}
+	return nil
+}
+
+func (imp *userImport) fail(line int, err error) {
+	imp.response.Failed++
+	if len(imp.response.Errors) < maxImportErrors {
+		imp.response.Errors = append(imp.response.Errors, &pb.ImportError{Line: int32(line), Error: batchError(err)})
+	}
+}
+
+// chunkReader reads the chunks of an ImportUsers stream as one payload
+type chunkReader struct {
+	stream pb.UserService_ImportUsersServer
+	chunk  []byte
+}
+
+func (reader *chunkReader) Read(p []byte) (int, error) {
+	for len(reader.chunk) == 0 {
+		req, err := reader.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		reader.chunk = req.Chunk
+	}
+
+	n := copy(p, reader.chunk)
+	reader.chunk = reader.chunk[n:]
+	return n, nil
+}
+
+// rowLimitReader fails with bufio.ErrTooLong past limit bytes of the payload,
+// csvRows moves the limit to maxImportLine past the start of each row. Without
+// it an unclosed quote reads the rest of the payload into one field.
+type rowLimitReader struct {
+	payload io.Reader
+	read    int64
+	limit   int64
+}
+
+func (reader *rowLimitReader) Read(p []byte) (int, error) {
+	if reader.read >= reader.limit {
+		return 0, bufio.ErrTooLong
+	}
+	if remaining := reader.limit - reader.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := reader.payload.Read(p)
+	reader.read += int64(n)
+	return n, err
+}
+
+// csvRows reads CSV rows whose columns are named by the header row
+type csvRows struct {
+	reader  *csv.Reader
+	limit   *rowLimitReader
+	columns []protoreflect.FieldDescriptor
+}
+
+func newCSVRows(payload io.Reader) (*csvRows, error) {
+	limit := &rowLimitReader{payload: payload, limit: maxImportLine}
+	reader := csv.NewReader(limit)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the CSV header is missing")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the columns are the CreateUserRequest fields, all strings
+	fields := (&pb.CreateUserRequest{}).ProtoReflect().Descriptor().Fields()
+	rows := &csvRows{reader: reader, limit: limit}
+	for _, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		field := fields.ByName(protoreflect.Name(name))
+		if field == nil {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		if slices.Contains(rows.columns, field) {
+			return nil, fmt.Errorf("repeated CSV column %q", name)
+		}
+		rows.columns = append(rows.columns, field)
+	}
+	return rows, nil
+}
+
+func (rows *csvRows) next() (importRow, error) {
+	rows.limit.limit = rows.reader.InputOffset() + maxImportLine
+	record, err := rows.reader.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		// the reader goes on with the next row
+		return importRow{Line: parseErr.StartLine, Err: status.Errorf(codes.InvalidArgument, "Invalid CSV row: %v", parseErr.Err)}, nil
+	}
+	if err != nil {
+		return importRow{}, err
+	}
+
+	line, _ := rows.reader.FieldPos(0)
+	user := &pb.CreateUserRequest{}
+	message := user.ProtoReflect()
+	for i, field := range rows.columns {
+		message.Set(field, protoreflect.ValueOfString(record[i]))
+	}
+	return importRow{Line: line, User: user}, nil
+}
+
+// ndjsonRows reads one JSON object per line, blank lines are skipped
+type ndjsonRows struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newNDJSONRows(payload io.Reader) *ndjsonRows {
+	scanner := bufio.NewScanner(payload)
+	scanner.Buffer(nil, maxImportLine)
+	return &ndjsonRows{scanner: scanner}
+}
+
+func (rows *ndjsonRows) next() (importRow, error) {
+	for rows.scanner.Scan() {
+		rows.line++
+		text := bytes.TrimSpace(rows.scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		user := &pb.CreateUserRequest{}
+		if err := protojson.Unmarshal(text, user); err != nil {
+			return importRow{Line: rows.line, Err: status.Errorf(codes.InvalidArgument, "Invalid JSON row: %v", err)}, nil
+		}
+		return importRow{Line: rows.line, User: user}, nil
+	}
+
+	if err := rows.scanner.Err(); err != nil {
+		return importRow{}, err
+	}
+	return importRow{}, io.EOF
+}
@@ -0,0 +1,185 @@
+package grpc_user
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// importStream sends a payload in chunks of chunkSize bytes
+type importStream struct {
+	grpc.ServerStream
+	requests []*pb.ImportUsersRequest
+	response *pb.ImportUsersResponse
+}
+
+func newImportStream(format pb.ImportFormat, dryRun bool, payload string, chunkSize int) *importStream {
+	stream := &importStream{}
+	for len(payload) > 0 {
+		size := min(chunkSize, len(payload))
+		stream.requests = append(stream.requests, &pb.ImportUsersRequest{Chunk: []byte(payload[:size])})
+		payload = payload[size:]
+	}
+	if len(stream.requests) == 0 {
+		stream.requests = append(stream.requests, &pb.ImportUsersRequest{})
+	}
+	stream.requests[0].Format = format
+	stream.requests[0].DryRun = dryRun
+	return stream
+}
+
+func (stream *importStream) Context() context.Context {
+	return context.Background()
+}
+
+func (stream *importStream) Recv() (*pb.ImportUsersRequest, error) {
+	if len(stream.requests) == 0 {
+		return nil, io.EOF
+	}
+	req := stream.requests[0]
+	stream.requests = stream.requests[1:]
+	return req, nil
+}
+
+func (stream *importStream) SendAndClose(response *pb.ImportUsersResponse) error {
+	stream.response = response
+	return nil
+}
+
+func TestImportUsers(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	require.NoError(t, user_repository.Create(ctx, &UserRecord{Id: "a", FirstName: "Cristiano", Nickname: "CR7", Email: "cristiano@ronaldo.com", Version: 1}))
+	publisher := NewRecordingPublisher()
+	svc := NewUserService(user_repository, publisher, WithBcryptCost(bcrypt.MinCost))
+
+	importUsers := func(t *testing.T, stream *importStream) *pb.ImportUsersResponse {
+		require.NoError(t, svc.ImportUsers(stream))
+		return stream.response
+	}
+	lines := func(response *pb.ImportUsersResponse) map[int32]codes.Code {
+		failed := make(map[int32]codes.Code)
+		for _, err := range response.Errors {
+			failed[err.Line] = codes.Code(err.Error.Code)
+		}
+		return failed
+	}
+
+	t.Run("CSV", func(t *testing.T) {
+		payload := "Email,first_name,last_name,nickname,country,password\n" +
+			"joao@felix.com,Joao,Felix,JF79,PT,Password123\n" +
+			"bruno@fernandes.com,Bruno,Fernandes,Bruno,XX,Password123\n" +
+			"JOAO@felix.com,Joao,Felix,Felix,PT,Password123\n" +
+			"ruben@dias.com,Ruben,Dias\n" +
+			"cristiano@ronaldo.com,Cristiano,Ronaldo,Cris,PT,Password123\n" +
+			"\"diogo@jota.com\",\"Diogo\",\"Jota\",JF79,PT,Password123\n" +
+			"\"vitinha@psg.fr\",\"Vitor\nFerreira\",Vitinha,Vitinha,PT,Password123\n"
+
+		// small chunks split rows and fields
+		response := importUsers(t, newImportStream(pb.ImportFormat_IMPORT_FORMAT_CSV, false, payload, 7))
+		require.Equal(t, int32(7), response.Rows)
+		require.Equal(t, int32(2), response.Imported)
+		require.Equal(t, int32(2), response.Duplicates)
+		require.Equal(t, int32(3), response.Failed)
+		require.Equal(t, map[int32]codes.Code{
+			3: codes.InvalidArgument,
+			5: codes.InvalidArgument,
+			7: codes.AlreadyExists,
+		}, lines(response))
+
+		imported, err := user_repository.FindByLogin(ctx, "joao@felix.com")
+		require.NoError(t, err)
+		require.Equal(t, "JF79", imported.Nickname)
+		require.True(t, checkPassword(imported.PasswordHash, "Password123"))
+
+		imported, err = user_repository.FindByLogin(ctx, "vitinha@psg.fr")
+		require.NoError(t, err)
+		require.Equal(t, "Vitor\nFerreira", imported.FirstName)
+	})
+
+	t.Run("NDJSON Dry Run", func(t *testing.T) {
+		payload := `{"firstName": "Diogo", "lastName": "Jota", "nickname": "Jota", "email": "diogo@jota.com", "country": "PT", "password": "Password123"}` + "\n" +
+			"\n" +
+			`{"first_name": "Ruben", "last_name": "Dias", "nickname": "Dias", "email": "ruben@dias.com", "country": "PT", "password": "Password123"}` + "\n" +
+			`{"first_name": "Ruben", "age": 27}` + "\n" +
+			`{"first_name": "Joao"` + "\n" +
+			`{"first_name": "Joao", "last_name": "Felix", "nickname": "Felix", "email": "joao@felix.com", "country": "PT", "password": "Password123"}`
+
+		response := importUsers(t, newImportStream(pb.ImportFormat_IMPORT_FORMAT_NDJSON, true, payload, 16))
+		require.True(t, response.DryRun)
+		require.Equal(t, int32(5), response.Rows)
+		require.Equal(t, int32(2), response.Imported)
+		require.Equal(t, int32(1), response.Duplicates)
+		require.Equal(t, map[int32]codes.Code{
+			4: codes.InvalidArgument,
+			5: codes.InvalidArgument,
+		}, lines(response))
+
+		_, err := user_repository.FindByLogin(ctx, "diogo@jota.com")
+		require.ErrorIs(t, err, ErrUserNotFound)
+	})
+
+	t.Run("Dry Run Catches Duplicates Across Batches", func(t *testing.T) {
+		payload := "email,first_name,last_name,nickname,country,password\n"
+		for i := 0; i <= importBatchSize; i++ {
+			payload += "pepe@example.com,Pepe,Pepe,Pepe,PT,Password123\n"
+		}
+
+		response := importUsers(t, newImportStream(pb.ImportFormat_IMPORT_FORMAT_CSV, true, payload, 1024))
+		require.Equal(t, int32(1), response.Imported)
+		require.Equal(t, int32(importBatchSize), response.Duplicates)
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		relay := NewOutboxRelay(user_repository, publisher)
+		delivered, err := relay.RelayOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 2, delivered)
+	})
+
+	t.Run("Invalid Payloads", func(t *testing.T) {
+		err := svc.ImportUsers(newImportStream(pb.ImportFormat_IMPORT_FORMAT_UNSPECIFIED, false, "", 1))
+		require.Equal(t, []string{"format"}, fieldViolations(t, err))
+
+		err = svc.ImportUsers(newImportStream(pb.ImportFormat_IMPORT_FORMAT_CSV, false, "email,age\n", 1024))
+		require.Equal(t, []string{"chunk"}, fieldViolations(t, err))
+
+		err = svc.ImportUsers(newImportStream(pb.ImportFormat_IMPORT_FORMAT_CSV, false, "", 1024))
+		require.Equal(t, []string{"chunk"}, fieldViolations(t, err))
+
+		line := make([]byte, maxImportLine+1)
+		for i := range line {
+			line[i] = ' '
+		}
+		err = svc.ImportUsers(newImportStream(pb.ImportFormat_IMPORT_FORMAT_NDJSON, false, string(line), 1024))
+		require.Equal(t, []string{"chunk"}, fieldViolations(t, err))
+
+		err = svc.ImportUsers(newImportStream(pb.ImportFormat_IMPORT_FORMAT_CSV, false, "email\n"+string(line)+"\n", 1024))
+		require.Equal(t, []string{"chunk"}, fieldViolations(t, err))
+	})
+
+	t.Run("Unclosed CSV Quote", func(t *testing.T) {
+		// the short lines after the quote would all be read into one field
+		payload := "email,first_name\njoao@felix.com,\"Joao\n" + strings.Repeat("bruno@fernandes.com,Bruno\n", maxImportLine/16)
+		err := svc.ImportUsers(newImportStream(pb.ImportFormat_IMPORT_FORMAT_CSV, true, payload, 1024))
+		require.Equal(t, []string{"chunk"}, fieldViolations(t, err))
+	})
+
+	t.Run("CSV Payload Longer Than A Row", func(t *testing.T) {
+		payload := "email,first_name\n\"pepe@example.com\",\"Kepler\nLaveran\"\n" + strings.Repeat("invalid,Bruno\n", maxImportLine/8)
+		stream := newImportStream(pb.ImportFormat_IMPORT_FORMAT_CSV, true, payload, 1024)
+		require.NoError(t, svc.ImportUsers(stream))
+		require.Equal(t, int32(maxImportLine/8+1), stream.response.Rows)
+		// the quoted newline stays in the row
+		require.Equal(t, int32(2), stream.response.Errors[0].Line)
+		require.Equal(t, int32(4), stream.response.Errors[1].Line)
+	})
+}
@@ -0,0 +1,169 @@
+package grpc_user
+
+import (
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+// listUsersFilter builds the Filter of a ListUsers request, all the conditions
+// must match
+func listUsersFilter(v *violations, req *pb.ListUsersRequest) Filter {
+	var filter And
+
+	for _, country := range req.Countries {
+		if !isCountryCode(country) {
+			v.add("countries", "%q is not an ISO 3166-1 alpha-2 country code", country)
+		}
+	}
+	countries := slices.Clone(req.Countries)
+	if req.Country != nil {
+		countries = append(countries, *req.Country)
+	}
+	switch len(countries) {
+	case 0:
+	case 1:
+		filter = append(filter, Condition{Field: "country", Op: OpEqual, Value: countries[0]})
+	default:
+		filter = append(filter, Condition{Field: "country", Op: OpIn, Values: countries})
+	}
+
+	if req.LastName != nil {
+		filter = append(filter, Condition{Field: "last_name", Op: OpEqual, Value: *req.LastName})
+	}
+	if condition, ok := stringMatch(v, "first_name_match", "first_name", req.FirstNameMatch); ok {
+		filter = append(filter, condition)
+	}
+	if condition, ok := stringMatch(v, "last_name_match", "last_name", req.LastNameMatch); ok {
+		filter = append(filter, condition)
+	}
+
+	if len(req.EmailDomains) > 0 {
+		var domains Or
+		for _, domain := range req.EmailDomains {
+			domain = strings.ToLower(strings.TrimPrefix(domain, "@"))
+			if domain == "" || strings.Contains(domain, "@") {
+				v.add("email_domains", "%q is not a domain", domain)
+				continue
+			}
+			// emails are stored lowercased, so the suffix doesn't need to ignore case
+			domains = append(domains, Condition{Field: "email", Op: OpSuffix, Value: "@" + domain})
+		}
+		filter = append(filter, domains)
+	}
+
+	filter = append(filter, timeRange(v, "created", "created_at", req.CreatedAfter, req.CreatedBefore)...)
+	filter = append(filter, timeRange(v, "updated", "updated_at", req.UpdatedAfter, req.UpdatedBefore)...)
+
+	if strings.TrimSpace(req.Filter) != "" {
+		parsed, err := parseFilter(req.Filter)
+		if err != nil {
+			v.add("filter", "%v", err)
+		} else {
+			filter = append(filter, parsed)
+		}
+	}
+
+	if len(filter) == 0 {
+		return nil
+	}
+	return filter
+}
+
+// visibleUsers hides the deleted users unless they are asked for
+func visibleUsers(filter Filter, showDeleted bool) Filter {
+	if showDeleted {
+		return filter
+	}
+
+	notDeleted := Condition{Field: "deleted_at", Op: OpEqual, Value: ""}
+	if filter == nil {
+		return notDeleted
+	}
+	return And{filter, notDeleted}
+}
+
+func stringMatch(v *violations, name string, field string, match *pb.StringMatch) (Condition, bool) {
+	if match == nil {
+		return Condition{}, false
+	}
+	if match.Value == "" {
+		v.add(name, "value must not be empty")
+		return Condition{}, false
+	}
+
+	op := OpEqual
+	if match.Prefix {
+		op = OpPrefix
+	}
+	return Condition{Field: field, Op: op, Value: match.Value, IgnoreCase: match.IgnoreCase}, true
+}
+
+// timeRange matches times in [after, before)
+func timeRange(v *violations, name string, field string, after *timestamppb.Timestamp, before *timestamppb.Timestamp) []Filter {
+	var conditions []Filter
+	if after != nil {
+		if err := after.CheckValid(); err != nil {
+			v.add(name+"_after", "%v", err)
+		} else {
+			conditions = append(conditions, Condition{Field: field, Op: OpGreaterOrEqual, Value: timeKey(after.AsTime())})
+		}
+	}
+	if before != nil {
+		if err := before.CheckValid(); err != nil {
+			v.add(name+"_before", "%v", err)
+		} else {
+			conditions = append(conditions, Condition{Field: field, Op: OpLess, Value: timeKey(before.AsTime())})
+		}
+	}
+	if len(conditions) == 2 && !after.AsTime().Before(before.AsTime()) {
+		v.add(name+"_before", "must be after %s_after", name)
+	}
+	return conditions
+}
+
+// parseOrderBy parses "field [asc|desc], ..." into the list order, id is
+// appended as the tie breaker
+func parseOrderBy(v *violations, field string, orderBy string) []SortField {
+	if strings.TrimSpace(orderBy) == "" {
+		return defaultSort
+	}
+
+	var sort []SortField
+	for _, clause := range strings.Split(orderBy, ",") {
+		parts := strings.Fields(clause)
+		if len(parts) == 0 || len(parts) > 2 {
+			v.add(field, "invalid clause %q", strings.TrimSpace(clause))
+			continue
+		}
+
+		key := SortField{Field: parts[0]}
+		if len(parts) == 2 {
+			switch strings.ToLower(parts[1]) {
+			case "asc":
+			case "desc":
+				key.Descending = true
+			default:
+				v.add(field, "invalid direction %q, use asc or desc", parts[1])
+				continue
+			}
+		}
+
+		switch {
+		case !slices.Contains(filterFields, key.Field):
+			v.add(field, "can't order by %q", key.Field)
+		case slices.ContainsFunc(sort, func(s SortField) bool { return s.Field == key.Field }):
+			v.add(field, "%q is listed more than once", key.Field)
+		default:
+			sort = append(sort, key)
+		}
+	}
+
+	if !slices.ContainsFunc(sort, func(s SortField) bool { return s.Field == "id" }) {
+		sort = append(sort, SortField{Field: "id"})
+	}
+	return sort
+}
@@ -0,0 +1,115 @@
+package grpc_user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestListFilters(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	for _, user := range []*UserRecord{
+		{Id: "a", FirstName: "Cristiano", LastName: "Ronaldo", Nickname: "CR7", Email: "cristiano@ronaldo.com", Country: "PT", CreatedAt: testTime("2025-01-10T10:00:00Z"), UpdatedAt: testTime("2025-03-01T10:00:00Z")},
+		{Id: "b", FirstName: "Ronaldo", LastName: "Nazario", Nickname: "R9", Email: "ronaldo@fenomeno.com.br", Country: "BR", CreatedAt: testTime("2025-02-10T10:00:00Z"), UpdatedAt: testTime("2025-02-10T10:00:00Z")},
+		{Id: "c", FirstName: "Ronaldinho", LastName: "Gaucho", Nickname: "R10", Email: "ronaldinho@gaucho.com.br", Country: "BR", CreatedAt: testTime("2025-03-10T10:00:00Z"), UpdatedAt: testTime("2025-03-10T10:00:00Z")},
+		{Id: "d", FirstName: "Mohammed", LastName: "Salah", Nickname: "MoSalah", Email: "mo@salah.com", Country: "EG", CreatedAt: testTime("2025-04-10T10:00:00Z"), UpdatedAt: testTime("2025-04-10T10:00:00Z")},
+	} {
+		require.NoError(t, user_repository.Create(ctx, user))
+	}
+
+	svc := NewUserService(user_repository, nil)
+
+	list := func(t *testing.T, req *pb.ListUsersRequest) []string {
+		resp, err := svc.ListUsers(ctx, req)
+		require.NoError(t, err)
+
+		var ids []string
+		for _, user := range resp.Users {
+			ids = append(ids, user.Id)
+		}
+		require.Equal(t, int32(len(ids)), resp.TotalCount)
+		return ids
+	}
+	date := func(value string) *timestamppb.Timestamp {
+		parsed, err := time.Parse(time.RFC3339, value)
+		require.NoError(t, err)
+		return timestamppb.New(parsed)
+	}
+
+	t.Run("Created Range", func(t *testing.T) {
+		require.Equal(t, []string{"b", "c"}, list(t, &pb.ListUsersRequest{
+			CreatedAfter:  date("2025-02-10T10:00:00Z"),
+			CreatedBefore: date("2025-04-10T10:00:00Z"),
+		}))
+	})
+
+	t.Run("Updated After", func(t *testing.T) {
+		require.Equal(t, []string{"a", "c", "d"}, list(t, &pb.ListUsersRequest{UpdatedAfter: date("2025-03-01T00:00:00+01:00")}))
+	})
+
+	t.Run("Countries", func(t *testing.T) {
+		require.Equal(t, []string{"a", "d"}, list(t, &pb.ListUsersRequest{Countries: []string{"PT", "EG"}}))
+	})
+
+	t.Run("Name Matching", func(t *testing.T) {
+		require.Equal(t, []string{"b", "c"}, list(t, &pb.ListUsersRequest{
+			FirstNameMatch: &pb.StringMatch{Value: "ronald", Prefix: true, IgnoreCase: true},
+		}))
+		require.Empty(t, list(t, &pb.ListUsersRequest{
+			FirstNameMatch: &pb.StringMatch{Value: "ronald", Prefix: true},
+		}))
+		require.Equal(t, []string{"a"}, list(t, &pb.ListUsersRequest{
+			LastNameMatch: &pb.StringMatch{Value: "RONALDO", IgnoreCase: true},
+		}))
+	})
+
+	t.Run("Email Domains", func(t *testing.T) {
+		require.Equal(t, []string{"a", "d"}, list(t, &pb.ListUsersRequest{EmailDomains: []string{"Salah.com", "@ronaldo.com"}}))
+	})
+
+	t.Run("Order By", func(t *testing.T) {
+		require.Equal(t, []string{"d", "a", "b", "c"}, list(t, &pb.ListUsersRequest{OrderBy: "last_name desc"}))
+		require.Equal(t, []string{"b", "c", "d", "a"}, list(t, &pb.ListUsersRequest{OrderBy: "country, created_at"}))
+	})
+
+	t.Run("Page Tokens Follow The Order", func(t *testing.T) {
+		var seen []string
+		req := &pb.ListUsersRequest{PageSize: 1, OrderBy: "country desc, created_at desc"}
+		for {
+			resp, err := svc.ListUsers(ctx, req)
+			require.NoError(t, err)
+			for _, user := range resp.Users {
+				seen = append(seen, user.Id)
+			}
+			if resp.NextPageToken == "" {
+				break
+			}
+			req.PageToken = resp.NextPageToken
+		}
+		require.Equal(t, []string{"a", "d", "c", "b"}, seen)
+
+		// tokens can't be used with another order
+		first, err := svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 1})
+		require.NoError(t, err)
+		_, err = svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 1, OrderBy: "last_name", PageToken: first.NextPageToken})
+		require.Equal(t, []string{"page_token"}, fieldViolations(t, err))
+	})
+
+	t.Run("Invalid Filters", func(t *testing.T) {
+		_, err := svc.ListUsers(ctx, &pb.ListUsersRequest{
+			Countries:      []string{"Portugal"},
+			FirstNameMatch: &pb.StringMatch{Prefix: true},
+			EmailDomains:   []string{""},
+			CreatedAfter:   date("2025-03-01T00:00:00Z"),
+			CreatedBefore:  date("2025-02-01T00:00:00Z"),
+			OrderBy:        "password, last_name sideways",
+		})
+		require.Equal(t, []string{"countries", "first_name_match", "email_domains", "created_before", "order_by", "order_by"}, fieldViolations(t, err))
+	})
+}
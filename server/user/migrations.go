@@ -0,0 +1,386 @@
+package grpc_user
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/zecst19/grpc-user/server/auth"
+	"github.com/zecst19/grpc-user/server/migrate"
+)
+
+const (
+	UserCollection = "users"
+)
+
+// Migrations are the schema changes of the users, outbox and token collections.
+// New ones are appended with the next version, released versions are never
+// renumbered or removed since databases record them by version. A released
+// migration is only changed to fix one that can't run, and must still leave
+// the databases that already applied it in the same state.
+func Migrations() []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "rename fields stored from the proto message",
+			Up:          renameLegacyFields,
+		},
+		{
+			Version:     2,
+			Description: "normalize emails",
+			Up:          normalizeEmails,
+		},
+		{
+			Version:     3,
+			Description: "backfill roles",
+			Up:          backfillRoles,
+		},
+		{
+			Version:     4,
+			Description: "create user indexes",
+			Up:          createUserIndexes,
+		},
+		{
+			Version:     5,
+			Description: "create outbox indexes",
+			Up:          createOutboxIndexes,
+		},
+		{
+			Version:     6,
+			Description: "backfill user versions",
+			Up:          backfillVersions,
+		},
+		{
+			Version:     7,
+			Description: "allow users without a nickname",
+			Up:          partialNicknameIndex,
+		},
+		{
+			Version:     8,
+			Description: "create list order indexes",
+			Up:          createListIndexes,
+		},
+		{
+			Version:     9,
+			Description: "store timestamps in UTC",
+			Up:          utcTimestamps,
+		},
+		{
+			Version:     10,
+			Description: "create search index",
+			Up:          createSearchIndex,
+		},
+		{
+			Version:     11,
+			Description: "create deleted user index",
+			Up:          createDeletedIndex,
+		},
+		{
+			Version:     12,
+			Description: "store timestamps as dates",
+			Up:          dateTimestamps,
+		},
+		{
+			Version:     13,
+			Description: "expire delivered outbox messages",
+			Up:          expireDeliveredOutbox,
+		},
+		{
+			Version:     14,
+			Description: "create token indexes",
+			Up:          auth.CreateTokenIndexes,
+		},
+		{
+			Version:     15,
+			Description: "create outbox key index",
+			Up:          createOutboxKeyIndex,
+		},
+		{
+			Version:     16,
+			Description: "index refresh tokens by subject",
+			Up:          auth.CreateSubjectIndex,
+		},
+	}
+}
+
+// users created before UserRecord were stored straight from pb.User, which the
+// driver encodes with lowercased Go field names
+func renameLegacyFields(ctx context.Context, db *mongo.Database) error {
+	renames := map[string]string{
+		"firstname": "first_name",
+		"lastname":  "last_name",
+		"createdat": "created_at",
+		"updatedat": "updated_at",
+	}
+
+	for from, to := range renames {
+		_, err := db.Collection(UserCollection).UpdateMany(ctx,
+			bson.M{from: bson.M{"$exists": true}, to: bson.M{"$exists": false}},
+			bson.M{"$rename": bson.M{from: to}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeEmails must run before the unique email index, emails that only
+// differ in case collide here and have to be fixed by hand
+func normalizeEmails(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(UserCollection).UpdateMany(ctx,
+		bson.M{"email": bson.M{"$type": "string"}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{"email": bson.M{"$toLower": bson.M{"$trim": bson.M{"input": "$email"}}}}}},
+		},
+	)
+	return err
+}
+
+func backfillRoles(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(UserCollection).UpdateMany(ctx,
+		bson.M{"roles": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"roles": bson.A{}}},
+	)
+	return err
+}
+
+// updates are conditional on the version, users created before it start at 1
+func backfillVersions(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(UserCollection).UpdateMany(ctx,
+		bson.M{"version": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"version": 1}},
+	)
+	return err
+}
+
+// the unique index names are matched by duplicateKeyError
+func createUserIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(UserCollection).Indexes().CreateMany(ctx, userIndexes())
+	return err
+}
+
+// nicknames are optional, so the unique index skips empty ones
+func userIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetName("id_1").SetUnique(true)},
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetName("email_1").SetUnique(true)},
+		{
+			Keys: bson.D{{Key: "nickname", Value: 1}},
+			Options: options.Index().
+				SetName("nickname_1").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"nickname": bson.M{"$gt": ""}}),
+		},
+		{Keys: bson.D{{Key: "country", Value: 1}}, Options: options.Index().SetName("country_1")},
+		{Keys: bson.D{{Key: "last_name", Value: 1}}, Options: options.Index().SetName("last_name_1")},
+	}
+}
+
+func createOutboxIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(outboxCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetName("id_1").SetUnique(true)},
+		{
+			Keys:    bson.D{{Key: "delivered_at", Value: 1}, {Key: "next_attempt_at", Value: 1}},
+			Options: options.Index().SetName("pending_1"),
+		},
+	})
+	return err
+}
+
+// migration 4 creates the partial index on new databases, older ones still
+// have the unique index that rejected a second empty nickname
+func partialNicknameIndex(ctx context.Context, db *mongo.Database) error {
+	indexes := db.Collection(UserCollection).Indexes()
+	if _, err := indexes.DropOne(ctx, "nickname_1"); err != nil && !isIndexNotFound(err) {
+		return err
+	}
+
+	_, err := indexes.CreateOne(ctx, indexByName(userIndexes(), "nickname_1"))
+	return err
+}
+
+// ListUsers sorts by (created_at, id), the filtered indexes replace the single
+// field ones so filtered pages don't need an in memory sort
+func createListIndexes(ctx context.Context, db *mongo.Database) error {
+	indexes := db.Collection(UserCollection).Indexes()
+	_, err := indexes.CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetName("created_at_1_id_1"),
+		},
+		{
+			Keys:    bson.D{{Key: "country", Value: 1}, {Key: "created_at", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetName("country_1_created_at_1_id_1"),
+		},
+		{
+			Keys:    bson.D{{Key: "last_name", Value: 1}, {Key: "created_at", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetName("last_name_1_created_at_1_id_1"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{"country_1", "last_name_1"} {
+		if _, err := indexes.DropOne(ctx, name); err != nil && !isIndexNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// created_at and updated_at are compared as strings by the list filters, which
+// only works if they all use the same offset
+func utcTimestamps(ctx context.Context, db *mongo.Database) error {
+	for _, field := range []string{"created_at", "updated_at"} {
+		utc := bson.M{"$dateToString": bson.M{
+			"date":   bson.M{"$dateFromString": bson.M{"dateString": "$" + field}},
+			"format": "%Y-%m-%dT%H:%M:%SZ",
+		}}
+		_, err := db.Collection(UserCollection).UpdateMany(ctx,
+			bson.M{field: bson.M{"$type": "string", "$not": primitive.Regex{Pattern: "Z$"}}},
+			mongo.Pipeline{{{Key: "$set", Value: bson.M{field: utc}}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Collection(UserCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "updated_at", Value: 1}, {Key: "id", Value: 1}},
+		Options: options.Index().SetName("updated_at_1_id_1"),
+	})
+	return err
+}
+
+// SearchUsers uses the text index, search_prefixes holds the word starts so
+// partial words match too. Stemming is off because names aren't words.
+func createSearchIndex(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection(UserCollection)
+
+	cursor, err := users.Find(ctx, bson.M{"search_prefixes": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		// only the searched fields are decoded, times are still strings when
+		// this runs and UserRecord now expects dates
+		var user struct {
+			Id        string `bson:"id"`
+			FirstName string `bson:"first_name"`
+			LastName  string `bson:"last_name"`
+			Nickname  string `bson:"nickname"`
+			Email     string `bson:"email"`
+		}
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+		_, err := users.UpdateOne(ctx,
+			bson.M{"id": user.Id},
+			bson.M{"$set": bson.M{"search_prefixes": searchPrefixes(&UserRecord{
+				FirstName: user.FirstName,
+				LastName:  user.LastName,
+				Nickname:  user.Nickname,
+				Email:     user.Email,
+			})}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	keys := bson.D{{Key: "search_prefixes", Value: "text"}}
+	weights := bson.D{{Key: "search_prefixes", Value: prefixWeight}}
+	for _, field := range searchFields {
+		keys = append(keys, bson.E{Key: field.Field, Value: "text"})
+		weights = append(weights, bson.E{Key: field.Field, Value: field.Weight})
+	}
+
+	_, err = users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: keys,
+		Options: options.Index().
+			SetName("search_text").
+			SetWeights(weights).
+			SetDefaultLanguage("none"),
+	})
+	return err
+}
+
+// the UserPurger looks for users deleted before the retention, only deleted
+// users are indexed
+func createDeletedIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(UserCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "deleted_at", Value: 1}, {Key: "id", Value: 1}},
+		Options: options.Index().
+			SetName("deleted_at_1_id_1").
+			SetPartialFilterExpression(bson.M{"deleted_at": bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+// times were RFC 3339 strings, as dates they sort and compare as times and the
+// filters can use the existing indexes
+func dateTimestamps(ctx context.Context, db *mongo.Database) error {
+	for _, field := range []string{"created_at", "updated_at", "deleted_at"} {
+		date := bson.M{"$dateFromString": bson.M{"dateString": "$" + field}}
+		_, err := db.Collection(UserCollection).UpdateMany(ctx,
+			bson.M{field: bson.M{"$type": "string"}},
+			mongo.Pipeline{{{Key: "$set", Value: bson.M{field: date}}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delivered messages are only kept for OutboxRetention, the relay never reads
+// them again
+func expireDeliveredOutbox(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(outboxCollection).Indexes().CreateOne(ctx, deliveredOutboxIndex())
+	return err
+}
+
+func deliveredOutboxIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{{Key: "delivered_at", Value: 1}},
+		Options: options.Index().
+			SetName("delivered_at_1").
+			SetExpireAfterSeconds(int32(OutboxRetention.Seconds())).
+			SetPartialFilterExpression(bson.M{"delivered_at": bson.M{"$exists": true}}),
+	}
+}
+
+// a claimed outbox message waits for the older undelivered messages of its key
+func createOutboxKeyIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(outboxCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "key", Value: 1}, {Key: "created_at", Value: 1}},
+		Options: options.Index().SetName("key_1_created_at_1"),
+	})
+	return err
+}
+
+func indexByName(indexes []mongo.IndexModel, name string) mongo.IndexModel {
+	for _, index := range indexes {
+		if *index.Options.Name == name {
+			return index
+		}
+	}
+	panic("unknown index " + name)
+}
+
+// isIndexNotFound lets migrations that drop an index run again
+func isIndexNotFound(err error) bool {
+	var commandErr mongo.CommandError
+	return errors.As(err, &commandErr) && commandErr.Code == 27
+}
@@ -0,0 +1,120 @@
+package grpc_user
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/zecst19/grpc-user/server/migrate"
+)
+
+// testDatabase is an empty database on the MongoDB at MONGODB_TEST_URI, dropped
+// after the test. Tests using it are skipped without one.
+func testDatabase(t *testing.T) *mongo.Database {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	require.NoError(t, err)
+
+	db := client.Database("grpc_user_test_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:16])
+	t.Cleanup(func() {
+		require.NoError(t, db.Drop(ctx))
+		require.NoError(t, client.Disconnect(ctx))
+	})
+	return db
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Versions Are Sequential", func(t *testing.T) {
+		for i, migration := range Migrations() {
+			require.Equal(t, i+1, migration.Version)
+			require.NotEmpty(t, migration.Description)
+			require.NotNil(t, migration.Up)
+		}
+	})
+
+	t.Run("Nickname Index Skips Empty Nicknames", func(t *testing.T) {
+		nickname := indexByName(userIndexes(), "nickname_1")
+		require.True(t, *nickname.Options.Unique)
+		require.Equal(t, bson.M{"nickname": bson.M{"$gt": ""}}, nickname.Options.PartialFilterExpression)
+	})
+
+	t.Run("Delivered Outbox Messages Expire", func(t *testing.T) {
+		index := deliveredOutboxIndex()
+		require.Equal(t, int32(7*24*60*60), *index.Options.ExpireAfterSeconds)
+		require.Equal(t, bson.M{"delivered_at": bson.M{"$exists": true}}, index.Options.PartialFilterExpression)
+
+		db := testDatabase(t)
+		_, err := migrate.NewRunner(db, migrate.NewInMemoryStore(), Migrations()).Up(ctx)
+		require.NoError(t, err)
+
+		cursor, err := db.Collection(outboxCollection).Indexes().List(ctx)
+		require.NoError(t, err)
+		var indexes []bson.M
+		require.NoError(t, cursor.All(ctx, &indexes))
+
+		var ttl bson.M
+		for _, index := range indexes {
+			if index["name"] == "delivered_at_1" {
+				ttl = index
+			}
+		}
+		require.NotNil(t, ttl)
+		require.EqualValues(t, 7*24*60*60, ttl["expireAfterSeconds"])
+		require.NotNil(t, ttl["partialFilterExpression"])
+	})
+
+	t.Run("Token Indexes", func(t *testing.T) {
+		db := testDatabase(t)
+		applied, err := migrate.NewRunner(db, migrate.NewInMemoryStore(), Migrations()).Up(ctx)
+		require.NoError(t, err)
+		require.Equal(t, len(Migrations()), len(applied))
+
+		for _, collection := range []string{"refresh_tokens", "revoked_tokens"} {
+			cursor, err := db.Collection(collection).Indexes().List(ctx)
+			require.NoError(t, err)
+			var indexes []bson.M
+			require.NoError(t, cursor.All(ctx, &indexes))
+
+			var ttl bson.M
+			for _, index := range indexes {
+				if index["name"] == "expires_at_1" {
+					ttl = index
+				}
+			}
+			require.NotNil(t, ttl, collection)
+			require.EqualValues(t, 0, ttl["expireAfterSeconds"])
+		}
+	})
+
+	t.Run("Users Without A Nickname", func(t *testing.T) {
+		db := testDatabase(t)
+		users := db.Collection(UserCollection)
+		_, err := users.InsertMany(ctx, []any{
+			bson.M{"id": "a", "firstname": "Cristiano", "email": "cristiano@ronaldo.com", "nickname": ""},
+			bson.M{"id": "b", "firstname": "Mohammed", "email": "mo@salah.com", "nickname": ""},
+		})
+		require.NoError(t, err)
+
+		_, err = migrate.NewRunner(db, migrate.NewInMemoryStore(), Migrations()).Up(ctx)
+		require.NoError(t, err)
+
+		_, err = users.InsertOne(ctx, bson.M{"id": "c", "email": "joao@felix.com", "nickname": "CR7"})
+		require.NoError(t, err)
+		_, err = users.InsertOne(ctx, bson.M{"id": "d", "email": "joao@cancelo.com", "nickname": "CR7"})
+		require.True(t, mongo.IsDuplicateKeyError(err))
+	})
+}
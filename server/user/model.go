@@ -0,0 +1,255 @@
+package grpc_user
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+// UserRecord is the stored form of a user. It holds the credentials, so it must
+// never be returned or published as is, use toProto to get the public view.
+// Times are BSON dates, see storeTime.
+type UserRecord struct {
+	Id           string    `bson:"id"`
+	FirstName    string    `bson:"first_name"`
+	LastName     string    `bson:"last_name"`
+	Nickname     string    `bson:"nickname"`
+	PasswordHash string    `bson:"password"`
+	Email        string    `bson:"email"`
+	Country      string    `bson:"country"`
+	CreatedAt    time.Time `bson:"created_at"`
+	UpdatedAt    time.Time `bson:"updated_at"`
+	Roles        []string  `bson:"roles"`
+	Version      int64     `bson:"version"`
+	// DeletedAt is set while the user is soft deleted
+	DeletedAt *time.Time `bson:"deleted_at,omitempty"`
+}
+
+func (rec *UserRecord) clone() *UserRecord {
+	copied := *rec
+	copied.Roles = slices.Clone(rec.Roles)
+	if rec.DeletedAt != nil {
+		deletedAt := *rec.DeletedAt
+		copied.DeletedAt = &deletedAt
+	}
+	return &copied
+}
+
+func (rec *UserRecord) deleted() bool {
+	return rec.DeletedAt != nil
+}
+
+// copyFields copies the named bson fields from another record, updated_at and
+// version are always copied
+func (rec *UserRecord) copyFields(from *UserRecord, fields []string) error {
+	for _, field := range slices.Concat(fields, []string{"updated_at", "version"}) {
+		if err := rec.copyField(from, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// project returns a record with only the named bson fields set
+func (rec *UserRecord) project(fields []string) (*UserRecord, error) {
+	projected := &UserRecord{}
+	for _, field := range fields {
+		if err := projected.copyField(rec, field); err != nil {
+			return nil, err
+		}
+	}
+	return projected, nil
+}
+
+func (rec *UserRecord) copyField(from *UserRecord, field string) error {
+	switch field {
+	case "id":
+		rec.Id = from.Id
+	case "first_name":
+		rec.FirstName = from.FirstName
+	case "last_name":
+		rec.LastName = from.LastName
+	case "nickname":
+		rec.Nickname = from.Nickname
+	case "password":
+		rec.PasswordHash = from.PasswordHash
+	case "email":
+		rec.Email = from.Email
+	case "country":
+		rec.Country = from.Country
+	case "created_at":
+		rec.CreatedAt = from.CreatedAt
+	case "updated_at":
+		rec.UpdatedAt = from.UpdatedAt
+	case "roles":
+		rec.Roles = slices.Clone(from.Roles)
+	case "version":
+		rec.Version = from.Version
+	case "deleted_at":
+		rec.DeletedAt = nil
+		if from.DeletedAt != nil {
+			deletedAt := *from.DeletedAt
+			rec.DeletedAt = &deletedAt
+		}
+	default:
+		return fmt.Errorf("unknown field %q", field)
+	}
+	return nil
+}
+
+// toProto returns the public view of the user
+func (rec *UserRecord) toProto() *pb.User {
+	return &pb.User{
+		Id:        rec.Id,
+		FirstName: rec.FirstName,
+		LastName:  rec.LastName,
+		Nickname:  rec.Nickname,
+		Email:     rec.Email,
+		Country:   rec.Country,
+		CreatedAt: timestamp(rec.CreatedAt),
+		UpdatedAt: timestamp(rec.UpdatedAt),
+		Roles:     slices.Clone(rec.Roles),
+		Version:   rec.Version,
+		DeletedAt: timestampOrNil(rec.DeletedAt),
+	}
+}
+
+// timestamp converts a stored time, the zero time is left unset
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func timestampOrNil(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamp(*t)
+}
+
+// legacyTime is the string form times had before they became Timestamps
+func legacyTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return formatTime(t)
+}
+
+// userEvent is the user in event payloads. Times stay RFC 3339 strings like
+// they were before User had Timestamps, so consumers keep working.
+type userEvent struct {
+	Id          string   `json:"id,omitempty"`
+	FirstName   string   `json:"first_name,omitempty"`
+	LastName    string   `json:"last_name,omitempty"`
+	Nickname    string   `json:"nickname,omitempty"`
+	Email       string   `json:"email,omitempty"`
+	Country     string   `json:"country,omitempty"`
+	CreatedAt   string   `json:"created_at,omitempty"`
+	UpdatedAt   string   `json:"updated_at,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	Version     int64    `json:"version,omitempty"`
+	DeletedAt   string   `json:"deleted_at,omitempty"`
+}
+
+// newUserEvent takes the public view of the user, so fields a read mask hides
+// stay hidden
+func newUserEvent(user *pb.User) *userEvent {
+	return &userEvent{
+		Id:          user.Id,
+		FirstName:   user.FirstName,
+		LastName:    user.LastName,
+		Nickname:    user.Nickname,
+		Email:       user.Email,
+		Country:     user.Country,
+		CreatedAt:   eventTime(user.CreatedAt),
+		UpdatedAt:   eventTime(user.UpdatedAt),
+		Roles:       user.Roles,
+		Permissions: user.Permissions,
+		Version:     user.Version,
+		DeletedAt:   eventTime(user.DeletedAt),
+	}
+}
+
+func newUserEvents(users []*pb.User) []*userEvent {
+	events := make([]*userEvent, len(users))
+	for i, user := range users {
+		events[i] = newUserEvent(user)
+	}
+	return events
+}
+
+func eventTime(t *timestamppb.Timestamp) string {
+	if t == nil {
+		return ""
+	}
+	return formatTime(t.AsTime())
+}
+
+type searchResultEvent struct {
+	User       *userEvent      `json:"user,omitempty"`
+	Score      float64         `json:"score,omitempty"`
+	Highlights []*pb.Highlight `json:"highlights,omitempty"`
+}
+
+type batchGetEvent struct {
+	Users      []*userEvent `json:"users,omitempty"`
+	MissingIds []string     `json:"missing_ids,omitempty"`
+}
+
+type passwordChangedEvent struct {
+	Id        string `json:"id"`
+	ChangedAt string `json:"changed_at"`
+}
+
+// userPurgedEvent only names the purged user, its data is gone
+type userPurgedEvent struct {
+	Id       string `json:"id"`
+	PurgedAt string `json:"purged_at"`
+}
+
+type roleChangedEvent struct {
+	Id     string   `json:"id"`
+	Role   string   `json:"role"`
+	Action string   `json:"action"`
+	Roles  []string `json:"roles"`
+}
+
+// storeTime is the precision times are stored with, BSON dates keep milliseconds
+// in UTC so the in-memory repository keeps the same
+func storeTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Millisecond)
+}
+
+// formatTime formats times for events and the legacy string fields
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// timeKeyLayout has a fixed width, so time keys sort in time order
+const timeKeyLayout = "2006-01-02T15:04:05.000Z"
+
+// timeKey is the string form of a time in filters and page tokens, the zero
+// time is ""
+func timeKey(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(timeKeyLayout)
+}
+
+func parseTimeKey(key string) (time.Time, error) {
+	return time.Parse(timeKeyLayout, key)
+}
+
+// normalizeEmail is applied to every stored email so uniqueness and logins are case-insensitive
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
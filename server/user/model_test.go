@@ -0,0 +1,117 @@
+package grpc_user
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testTime parses an RFC 3339 fixture time
+func testTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestTimes(t *testing.T) {
+	t.Run("Stored In UTC Milliseconds", func(t *testing.T) {
+		local := time.Date(2025, 3, 22, 19, 37, 0, 123456789, time.FixedZone("CET", 3600))
+		require.Equal(t, time.Date(2025, 3, 22, 18, 37, 0, 123000000, time.UTC), storeTime(local))
+	})
+
+	t.Run("Time Keys Sort In Time Order", func(t *testing.T) {
+		require.Equal(t, "2025-03-22T18:37:00.000Z", timeKey(testTime("2025-03-22T18:37:00Z")))
+		require.Less(t, timeKey(testTime("2025-03-22T18:37:00Z")), timeKey(testTime("2025-03-22T18:37:00.5Z")))
+		require.Empty(t, timeKey(time.Time{}))
+
+		parsed, err := parseTimeKey("2025-03-22T18:37:00.500Z")
+		require.NoError(t, err)
+		require.Equal(t, testTime("2025-03-22T18:37:00.5Z"), parsed)
+	})
+
+	t.Run("Proto Timestamps", func(t *testing.T) {
+		deletedAt := testTime("2025-03-24T08:00:00Z")
+		user := (&UserRecord{CreatedAt: testTime("2025-03-22T18:37:00Z"), DeletedAt: &deletedAt}).toProto()
+		require.Equal(t, testTime("2025-03-22T18:37:00Z"), user.CreatedAt.AsTime())
+		require.Nil(t, user.UpdatedAt)
+		require.Equal(t, deletedAt, user.DeletedAt.AsTime())
+	})
+
+	t.Run("Legacy Timestamps", func(t *testing.T) {
+		user := &UserRecord{Id: "a", CreatedAt: testTime("2025-03-22T18:37:00Z"), UpdatedAt: testTime("2025-03-23T10:00:00Z")}
+
+		legacy := NewUserService(NewInMemoryUserRepository(), nil).toProto(user)
+		require.Equal(t, "2025-03-22T18:37:00Z", legacy.LegacyCreatedAt)
+		require.Equal(t, "2025-03-23T10:00:00Z", legacy.LegacyUpdatedAt)
+
+		current := NewUserService(NewInMemoryUserRepository(), nil, WithLegacyTimestamps(false)).toProto(user)
+		require.Empty(t, current.LegacyCreatedAt)
+		require.Empty(t, current.LegacyUpdatedAt)
+		require.NotNil(t, current.CreatedAt)
+	})
+
+	t.Run("Events Keep RFC 3339 Strings", func(t *testing.T) {
+		deletedAt := testTime("2025-03-24T08:00:00.250Z")
+		user := &UserRecord{
+			Id:        "a",
+			FirstName: "Cristiano",
+			Email:     "cristiano@ronaldo.com",
+			CreatedAt: testTime("2025-03-22T18:37:00.123Z"),
+			UpdatedAt: testTime("2025-03-23T10:00:00Z"),
+			Roles:     []string{"support"},
+			Version:   2,
+			DeletedAt: &deletedAt,
+		}
+		svc := NewUserService(NewInMemoryUserRepository(), nil, WithLegacyTimestamps(false))
+
+		message, err := NewOutboxMessage("user.deleted", newUserEvent(svc.toProto(user)))
+		require.NoError(t, err)
+		require.JSONEq(t, `{
+			"id": "a",
+			"first_name": "Cristiano",
+			"email": "cristiano@ronaldo.com",
+			"created_at": "2025-03-22T18:37:00Z",
+			"updated_at": "2025-03-23T10:00:00Z",
+			"roles": ["support"],
+			"permissions": ["users.read", "users.list"],
+			"version": 2,
+			"deleted_at": "2025-03-24T08:00:00Z"
+		}`, string(message.Payload))
+
+		// events published straight to Kafka are encoded the same way
+		encoded, err := json.Marshal(Message{Event: "user.get", Value: newUserEvent(svc.toProto(&UserRecord{Id: "a", CreatedAt: user.CreatedAt}))})
+		require.NoError(t, err)
+		require.Equal(t, `{"event":"user.get","value":{"id":"a","created_at":"2025-03-22T18:37:00Z"}}`, string(encoded))
+	})
+
+	t.Run("MongoDB Dates", func(t *testing.T) {
+		require.Equal(t, bson.M{"created_at": bson.M{"$lt": testTime("2025-03-22T18:37:00Z")}},
+			mongoFilter(Condition{Field: "created_at", Op: OpLess, Value: "2025-03-22T18:37:00.000Z"}))
+		require.Equal(t, bson.M{"deleted_at": bson.M{"$nin": bson.A{nil, ""}}},
+			mongoFilter(Condition{Field: "deleted_at", Op: OpNotEqual, Value: ""}))
+		require.Equal(t, "PT", mongoValue("country", "PT"))
+
+		after := mongoAfter([]SortField{{Field: "created_at"}, {Field: "id"}}, &Cursor{Values: []string{"2025-03-22T18:37:00.000Z", "a"}})
+		require.Equal(t, bson.M{"$or": bson.A{
+			bson.M{"created_at": bson.M{"$gt": testTime("2025-03-22T18:37:00Z")}},
+			bson.M{"created_at": testTime("2025-03-22T18:37:00Z"), "id": bson.M{"$gt": "a"}},
+		}}, after)
+	})
+
+	t.Run("Page Tokens Hold Valid Times", func(t *testing.T) {
+		sort := []SortField{{Field: "created_at"}, {Field: "id"}}
+		token := encodePageToken(&UserRecord{Id: "a", CreatedAt: testTime("2025-03-22T18:37:00Z")}, sort, "")
+		_, err := decodePageToken(token, "", sort)
+		require.NoError(t, err)
+
+		forged := base64.RawURLEncoding.EncodeToString([]byte(`{"v":["yesterday","a"]}`))
+		_, err = decodePageToken(forged, "", sort)
+		require.ErrorIs(t, err, errInvalidPageToken)
+	})
+}
@@ -0,0 +1,199 @@
+package grpc_user
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	outboxCollection = "outbox"
+
+	// OutboxRetention is how long delivered messages stay in the outbox
+	OutboxRetention = 7 * 24 * time.Hour
+)
+
+// OutboxMessage is an event written in the same transaction as the user change
+// that caused it, the OutboxRelay publishes it afterwards
+type OutboxMessage struct {
+	Id    string `bson:"id"`
+	Event string `bson:"event"`
+	// Key is the id of the user the event is about, the events of a key are
+	// published in the order they were created
+	Key           string     `bson:"key,omitempty"`
+	Payload       []byte     `bson:"payload"`
+	CreatedAt     time.Time  `bson:"created_at"`
+	Attempts      int        `bson:"attempts"`
+	NextAttemptAt time.Time  `bson:"next_attempt_at"`
+	DeliveredAt   *time.Time `bson:"delivered_at,omitempty"`
+	LastError     string     `bson:"last_error,omitempty"`
+	// LeaseOwner is the relay publishing the message, no other relay claims
+	// it until LeaseExpiresAt
+	LeaseOwner     string     `bson:"lease_owner,omitempty"`
+	LeaseExpiresAt *time.Time `bson:"lease_expires_at,omitempty"`
+}
+
+func NewOutboxMessage(event string, value any) (*OutboxMessage, error) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &OutboxMessage{
+		Id:            uuid.New().String(),
+		Event:         event,
+		Payload:       payload,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}, nil
+}
+
+// OutboxRepository gives the OutboxRelay access to the undelivered events
+type OutboxRepository interface {
+	// ClaimOutbox leases up to limit undelivered messages due at now to owner
+	// until leaseUntil, oldest first, skipping the ones leased to other owners.
+	// A message is only claimed once every older message of its key is
+	// delivered or claimed in the same call.
+	ClaimOutbox(ctx context.Context, owner string, now time.Time, leaseUntil time.Time, limit int) ([]*OutboxMessage, error)
+	MarkDelivered(ctx context.Context, id string, deliveredAt time.Time) error
+	// MarkFailed schedules the next attempt and releases the lease
+	MarkFailed(ctx context.Context, id string, nextAttemptAt time.Time, lastError string) error
+}
+
+// OutboxRelay publishes outbox messages, retrying failed ones with exponential
+// backoff until they are delivered. Every server runs one, the leases keep
+// them from publishing the same message.
+type OutboxRelay struct {
+	outbox    OutboxRepository
+	publisher EventPublisher
+	now       func() time.Time
+	owner     string
+
+	Interval    time.Duration
+	BatchSize   int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Lease is how long a claimed batch has to be published before another
+	// relay may claim it again
+	Lease time.Duration
+}
+
+func NewOutboxRelay(outbox OutboxRepository, publisher EventPublisher) *OutboxRelay {
+	return &OutboxRelay{
+		outbox:      outbox,
+		publisher:   publisher,
+		now:         time.Now,
+		owner:       uuid.New().String(),
+		Interval:    time.Second,
+		BatchSize:   100,
+		BaseBackoff: time.Second,
+		MaxBackoff:  5 * time.Minute,
+		Lease:       time.Minute,
+	}
+}
+
+// Run relays messages every Interval until ctx is cancelled
+func (relay *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(relay.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := relay.RelayOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Outbox relay failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RelayOnce publishes one batch of pending messages and returns how many were delivered
+func (relay *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	now := relay.now()
+	messages, err := relay.outbox.ClaimOutbox(ctx, relay.owner, now, now.Add(relay.Lease), relay.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// the messages are published in segments cut before a key repeats, so a
+	// key's messages go out in order and stop at its first failure. The
+	// messages left behind keep their lease until the failed one is retried.
+	delivered := 0
+	failed := make(map[string]bool)
+	for len(messages) > 0 {
+		var segment []*OutboxMessage
+		inSegment := make(map[string]bool)
+		for len(messages) > 0 {
+			message := messages[0]
+			if message.Key != "" && inSegment[message.Key] {
+				break
+			}
+			messages = messages[1:]
+			if failed[message.Key] {
+				continue
+			}
+			if message.Key != "" {
+				inSegment[message.Key] = true
+			}
+			segment = append(segment, message)
+		}
+
+		for i, err := range relay.publishAll(ctx, segment) {
+			message := segment[i]
+			if err != nil {
+				log.Printf("Failed to relay event %v (%v), attempt %d: %v", message.Id, message.Event, message.Attempts+1, err)
+				if message.Key != "" {
+					failed[message.Key] = true
+				}
+				if err := relay.outbox.MarkFailed(ctx, message.Id, now.Add(relay.backoff(message.Attempts)), err.Error()); err != nil {
+					return delivered, err
+				}
+				continue
+			}
+
+			if err := relay.outbox.MarkDelivered(ctx, message.Id, relay.now()); err != nil {
+				return delivered, err
+			}
+			delivered++
+		}
+	}
+
+	return delivered, nil
+}
+
+// publishAll publishes the messages in one batch if the publisher supports it,
+// one at a time otherwise, and returns the error of each
+func (relay *OutboxRelay) publishAll(ctx context.Context, messages []*OutboxMessage) []error {
+	values := make([]Message, len(messages))
+	for i, message := range messages {
+		values[i] = Message{Event: message.Event, Key: message.Key, Value: json.RawMessage(message.Payload)}
+	}
+
+	if batch, ok := relay.publisher.(BatchPublisher); ok {
+		return batch.PublishBatch(ctx, values)
+	}
+
+	errs := make([]error, len(values))
+	for i, value := range values {
+		errs[i] = relay.publisher.Publish(ctx, value)
+	}
+	return errs
+}
+
+func (relay *OutboxRelay) backoff(attempts int) time.Duration {
+	backoff := relay.BaseBackoff
+	for i := 0; i < attempts && backoff < relay.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > relay.MaxBackoff {
+		backoff = relay.MaxBackoff
+	}
+	return backoff
+}
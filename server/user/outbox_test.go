@@ -0,0 +1,148 @@
+package grpc_user
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+type flakyPublisher struct {
+	RecordingPublisher
+	failures int
+}
+
+func (pub *flakyPublisher) Publish(ctx context.Context, message Message) error {
+	if pub.failures > 0 {
+		pub.failures--
+		return errors.New("kafka: client has run out of available brokers")
+	}
+	return pub.RecordingPublisher.Publish(ctx, message)
+}
+
+func TestOutboxRelay(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	publisher := &flakyPublisher{failures: 1}
+
+	now := time.Date(2025, 3, 22, 18, 37, 0, 0, time.UTC)
+	relay := NewOutboxRelay(user_repository, publisher)
+	relay.now = func() time.Time { return now }
+
+	event, err := NewOutboxMessage("user.created", &pb.User{Id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+	require.NoError(t, err)
+	event.NextAttemptAt = now
+
+	err = user_repository.Create(ctx, &UserRecord{Id: "86f9f466-851a-4b93-af21-d5f52ac91006"}, event)
+	require.NoError(t, err)
+
+	t.Run("Failed Publish Is Retried Later", func(t *testing.T) {
+		delivered, err := relay.RelayOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, delivered)
+
+		pending, err := user_repository.PendingOutbox(ctx, now.Add(relay.BaseBackoff), 10)
+		require.NoError(t, err)
+		require.Len(t, pending, 1)
+		require.Equal(t, 1, pending[0].Attempts)
+		require.NotEmpty(t, pending[0].LastError)
+
+		// still backing off
+		delivered, err = relay.RelayOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, delivered)
+		require.Empty(t, publisher.Events())
+	})
+
+	t.Run("Delivered After Backoff", func(t *testing.T) {
+		now = now.Add(relay.BaseBackoff)
+
+		delivered, err := relay.RelayOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, delivered)
+		require.Equal(t, []string{"user.created"}, publisher.Events())
+
+		pending, err := user_repository.PendingOutbox(ctx, now.Add(time.Hour), 10)
+		require.NoError(t, err)
+		require.Empty(t, pending)
+
+		// the in-memory outbox only keeps undelivered messages
+		require.Empty(t, user_repository.outbox)
+		require.Empty(t, user_repository.outboxById)
+	})
+
+	t.Run("Claimed Once", func(t *testing.T) {
+		repository := NewInMemoryUserRepository()
+		event, err := NewOutboxMessage("user.created", &pb.User{Id: "a"})
+		require.NoError(t, err)
+		event.Key = "a"
+		event.NextAttemptAt = now
+		require.NoError(t, repository.Create(ctx, &UserRecord{Id: "a"}, event))
+
+		claimed, err := repository.ClaimOutbox(ctx, "relay-1", now, now.Add(time.Minute), 10)
+		require.NoError(t, err)
+		require.Len(t, claimed, 1)
+
+		claimed, err = repository.ClaimOutbox(ctx, "relay-2", now, now.Add(time.Minute), 10)
+		require.NoError(t, err)
+		require.Empty(t, claimed)
+
+		// the lease of a relay that stopped runs out
+		claimed, err = repository.ClaimOutbox(ctx, "relay-2", now.Add(time.Minute), now.Add(2*time.Minute), 10)
+		require.NoError(t, err)
+		require.Len(t, claimed, 1)
+		require.Equal(t, "relay-2", claimed[0].LeaseOwner)
+	})
+
+	t.Run("Failure Holds Back The Events Of The User", func(t *testing.T) {
+		repository := NewInMemoryUserRepository()
+		events := func(key string, names ...string) []*OutboxMessage {
+			var messages []*OutboxMessage
+			for _, name := range names {
+				message, err := NewOutboxMessage(name, &pb.User{Id: key})
+				require.NoError(t, err)
+				message.Key = key
+				message.NextAttemptAt = now
+				messages = append(messages, message)
+			}
+			return messages
+		}
+		require.NoError(t, repository.Create(ctx, &UserRecord{Id: "a"}, events("a", "user.created", "user.update")...))
+		require.NoError(t, repository.Create(ctx, &UserRecord{Id: "b", Email: "b"}, events("b", "user.created")...))
+
+		publisher := &flakyPublisher{failures: 1}
+		relay := NewOutboxRelay(repository, publisher)
+		relay.now = func() time.Time { return now }
+		relay.Lease = relay.BaseBackoff / 4
+
+		// the first user.created fails, its update waits for it
+		delivered, err := relay.RelayOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, delivered)
+		require.Equal(t, "b", publisher.Messages()[0].Key)
+
+		// another relay can't get ahead of it either, once the lease of the
+		// update ran out
+		claimed, err := repository.ClaimOutbox(ctx, "relay-2", now.Add(relay.BaseBackoff/2), now.Add(time.Minute), 10)
+		require.NoError(t, err)
+		require.Empty(t, claimed)
+
+		later := now.Add(relay.BaseBackoff)
+		relay.now = func() time.Time { return later }
+		delivered, err = relay.RelayOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 2, delivered)
+		require.Equal(t, []string{"user.created", "user.created", "user.update"}, publisher.Events())
+		require.Equal(t, "a", publisher.Messages()[1].Key)
+	})
+
+	t.Run("Backoff Is Capped", func(t *testing.T) {
+		require.Equal(t, relay.BaseBackoff, relay.backoff(0))
+		require.Equal(t, 4*relay.BaseBackoff, relay.backoff(2))
+		require.Equal(t, relay.MaxBackoff, relay.backoff(100))
+	})
+}
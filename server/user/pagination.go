@@ -0,0 +1,127 @@
+package grpc_user
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 1000
+)
+
+var (
+	errInvalidPageToken = errors.New("invalid page token")
+	errStalePageToken   = errors.New("page token was issued for other filters")
+	errStaleSearchToken = errors.New("page token was issued for another query")
+)
+
+// Cursor is the position of a user in the list order, its values are the sort
+// key of the last user of a page and the next page starts right after it
+type Cursor struct {
+	Values []string `json:"v"`
+}
+
+// pageToken is what next_page_token encodes, Filter ties it to the filters and
+// order of the request that produced it
+type pageToken struct {
+	Cursor
+	Filter string `json:"f"`
+}
+
+func encodePageToken(user *UserRecord, sort []SortField, filter string) string {
+	data, _ := json.Marshal(pageToken{
+		Cursor: Cursor{Values: sortKey(user, sort)},
+		Filter: filter,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePageToken(token string, filter string, sort []SortField) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidPageToken
+	}
+
+	var decoded pageToken
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, errInvalidPageToken
+	}
+	if decoded.Filter != filter {
+		return nil, errStalePageToken
+	}
+	if len(decoded.Values) != len(sort) {
+		return nil, errInvalidPageToken
+	}
+	for i, field := range sort {
+		// time keys are turned back into dates for MongoDB
+		if !slices.Contains(timeFields, field.Field) || decoded.Values[i] == "" {
+			continue
+		}
+		if _, err := parseTimeKey(decoded.Values[i]); err != nil {
+			return nil, errInvalidPageToken
+		}
+	}
+
+	return &decoded.Cursor, nil
+}
+
+// searchPageToken is the next_page_token of SearchUsers, scores can't be
+// compared across writes so search pages by offset
+type searchPageToken struct {
+	Offset int64  `json:"o"`
+	Query  string `json:"q"`
+}
+
+func encodeSearchPageToken(offset int64, terms []string, showDeleted bool) string {
+	data, _ := json.Marshal(searchPageToken{Offset: offset, Query: searchQuery(terms, showDeleted)})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSearchPageToken(token string, terms []string, showDeleted bool) (int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, errInvalidPageToken
+	}
+
+	var decoded searchPageToken
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Offset < 0 {
+		return 0, errInvalidPageToken
+	}
+	if decoded.Query != searchQuery(terms, showDeleted) {
+		return 0, errStaleSearchToken
+	}
+
+	return decoded.Offset, nil
+}
+
+// searchQuery fingerprints what a search selects
+func searchQuery(terms []string, showDeleted bool) string {
+	hash := sha256.Sum256(fmt.Appendf(nil, "%s|%t", strings.Join(terms, " "), showDeleted))
+	return hex.EncodeToString(hash[:8])
+}
+
+// listFilter fingerprints everything in the request that selects users, so
+// adding a filter field doesn't need changes here
+func listFilter(req *pb.ListUsersRequest) string {
+	filter := proto.Clone(req).(*pb.ListUsersRequest)
+	filter.Page = 0
+	filter.PageSize = 0
+	filter.PageToken = ""
+	filter.ReadMask = nil
+	filter.CountMode = pb.CountMode_COUNT_MODE_EXACT
+
+	data, _ := proto.MarshalOptions{Deterministic: true}.Marshal(filter)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:8])
+}
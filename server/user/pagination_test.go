@@ -0,0 +1,185 @@
+package grpc_user
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+func TestPagination(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	seed := []*UserRecord{
+		{Id: "e", Nickname: "Eusebio", Country: "PT", CreatedAt: testTime("2025-03-22T18:37:04Z")},
+		{Id: "a", Nickname: "Figo", Country: "PT", CreatedAt: testTime("2025-03-22T18:37:00Z")},
+		{Id: "c", Nickname: "Rui", Country: "PT", CreatedAt: testTime("2025-03-22T18:37:02Z")},
+		{Id: "b", Nickname: "Pauleta", Country: "PT", CreatedAt: testTime("2025-03-22T18:37:02Z")},
+		{Id: "d", Nickname: "Deco", Country: "BR", CreatedAt: testTime("2025-03-22T18:37:03Z")},
+	}
+	for _, user := range seed {
+		require.NoError(t, user_repository.Create(ctx, user))
+	}
+
+	svc := NewUserService(user_repository, nil)
+
+	ids := func(users []*pb.User) []string {
+		var ids []string
+		for _, user := range users {
+			ids = append(ids, user.Id)
+		}
+		return ids
+	}
+
+	t.Run("Page Through With Tokens", func(t *testing.T) {
+		var seen []string
+		token := ""
+		for {
+			resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 2, PageToken: token})
+			require.NoError(t, err)
+			seen = append(seen, ids(resp.Users)...)
+			if resp.NextPageToken == "" {
+				break
+			}
+			token = resp.NextPageToken
+		}
+		// ties on created_at are broken by id
+		require.Equal(t, []string{"a", "b", "c", "d", "e"}, seen)
+	})
+
+	t.Run("Writes Between Pages", func(t *testing.T) {
+		resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 2})
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "b"}, ids(resp.Users))
+
+		// a user created before the cursor and a deleted one don't shift the next page
+		require.NoError(t, user_repository.Create(ctx, &UserRecord{Id: "0", Nickname: "Coluna", CreatedAt: testTime("2025-03-22T18:36:00Z")}))
+		_, err = svc.DeleteUser(ctx, &pb.DeleteUserRequest{Id: "a"})
+		require.NoError(t, err)
+
+		resp, err = svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 2, PageToken: resp.NextPageToken})
+		require.NoError(t, err)
+		require.Equal(t, []string{"c", "d"}, ids(resp.Users))
+
+		_, err = svc.DeleteUser(ctx, &pb.DeleteUserRequest{Id: "0"})
+		require.NoError(t, err)
+		require.NoError(t, user_repository.Create(ctx, seed[1]))
+	})
+
+	t.Run("Page Numbers", func(t *testing.T) {
+		resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{Page: 2, PageSize: 2})
+		require.NoError(t, err)
+		require.Equal(t, []string{"c", "d"}, ids(resp.Users))
+		require.NotEmpty(t, resp.NextPageToken)
+
+		// page 0 is the first page
+		resp, err = svc.ListUsers(ctx, &pb.ListUsersRequest{Page: 0, PageSize: 2})
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "b"}, ids(resp.Users))
+
+		resp, err = svc.ListUsers(ctx, &pb.ListUsersRequest{Page: 3, PageSize: 2})
+		require.NoError(t, err)
+		require.Equal(t, []string{"e"}, ids(resp.Users))
+		require.Empty(t, resp.NextPageToken)
+	})
+
+	t.Run("Token Is Tied To Filters", func(t *testing.T) {
+		country := "PT"
+		resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 2, Country: &country})
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "b"}, ids(resp.Users))
+
+		next, err := svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 2, Country: &country, PageToken: resp.NextPageToken})
+		require.NoError(t, err)
+		require.Equal(t, []string{"c", "e"}, ids(next.Users))
+
+		_, err = svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 2, PageToken: resp.NextPageToken})
+		require.Equal(t, []string{"page_token"}, fieldViolations(t, err))
+	})
+
+	t.Run("Invalid Paging", func(t *testing.T) {
+		_, err := svc.ListUsers(ctx, &pb.ListUsersRequest{Page: -1, PageSize: -5})
+		require.Equal(t, []string{"page", "page_size"}, fieldViolations(t, err))
+
+		_, err = svc.ListUsers(ctx, &pb.ListUsersRequest{PageToken: "not a token"})
+		require.Equal(t, []string{"page_token"}, fieldViolations(t, err))
+
+		resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 2})
+		require.NoError(t, err)
+		_, err = svc.ListUsers(ctx, &pb.ListUsersRequest{Page: 2, PageSize: 2, PageToken: resp.NextPageToken})
+		require.Equal(t, []string{"page_token"}, fieldViolations(t, err))
+	})
+
+	t.Run("Page Size", func(t *testing.T) {
+		var v violations
+		require.Equal(t, DefaultPageSize, validatePaging(&v, &pb.ListUsersRequest{}))
+		require.Equal(t, MaxPageSize, validatePaging(&v, &pb.ListUsersRequest{PageSize: 5000}))
+		require.Empty(t, v)
+
+		resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{})
+		require.NoError(t, err)
+		require.Len(t, resp.Users, 5)
+		require.Empty(t, resp.NextPageToken)
+	})
+}
+
+func TestCountMode(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	for _, user := range []*UserRecord{
+		{Id: "a", Nickname: "Figo", Country: "PT", CreatedAt: testTime("2025-03-22T18:37:00Z")},
+		{Id: "b", Nickname: "Pauleta", Country: "PT", CreatedAt: testTime("2025-03-22T18:37:01Z")},
+		{Id: "c", Nickname: "Deco", Country: "BR", CreatedAt: testTime("2025-03-22T18:37:02Z")},
+	} {
+		require.NoError(t, user_repository.Create(ctx, user))
+	}
+
+	svc := NewUserService(user_repository, nil)
+	country := "PT"
+
+	t.Run("Exact Count Honors Filters", func(t *testing.T) {
+		resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 1, Country: &country})
+		require.NoError(t, err)
+		require.Len(t, resp.Users, 1)
+		require.Equal(t, int32(2), resp.TotalCount)
+		require.Equal(t, pb.CountMode_COUNT_MODE_EXACT, resp.CountMode)
+	})
+
+	t.Run("No Count", func(t *testing.T) {
+		resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{CountMode: pb.CountMode_COUNT_MODE_NONE})
+		require.NoError(t, err)
+		require.Len(t, resp.Users, 3)
+		require.Zero(t, resp.TotalCount)
+		require.Equal(t, pb.CountMode_COUNT_MODE_NONE, resp.CountMode)
+	})
+
+	t.Run("Estimated Count", func(t *testing.T) {
+		resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{CountMode: pb.CountMode_COUNT_MODE_ESTIMATED})
+		require.NoError(t, err)
+		require.Equal(t, int32(3), resp.TotalCount)
+		require.Equal(t, pb.CountMode_COUNT_MODE_ESTIMATED, resp.CountMode)
+
+		// estimates can't apply filters, so filtered requests are counted exactly
+		resp, err = svc.ListUsers(ctx, &pb.ListUsersRequest{CountMode: pb.CountMode_COUNT_MODE_ESTIMATED, Country: &country})
+		require.NoError(t, err)
+		require.Equal(t, int32(2), resp.TotalCount)
+		require.Equal(t, pb.CountMode_COUNT_MODE_EXACT, resp.CountMode)
+	})
+
+	t.Run("Count Mode Doesn't Change Page Tokens", func(t *testing.T) {
+		resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 1})
+		require.NoError(t, err)
+
+		next, err := svc.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 1, PageToken: resp.NextPageToken, CountMode: pb.CountMode_COUNT_MODE_NONE})
+		require.NoError(t, err)
+		require.Equal(t, "b", next.Users[0].Id)
+	})
+
+	t.Run("Unknown Count Mode", func(t *testing.T) {
+		_, err := svc.ListUsers(ctx, &pb.ListUsersRequest{CountMode: pb.CountMode(42)})
+		require.Equal(t, []string{"count_mode"}, fieldViolations(t, err))
+	})
+}
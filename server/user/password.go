@@ -0,0 +1,87 @@
+package grpc_user
+
+import (
+	"errors"
+	"fmt"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	DefaultBcryptCost = 14
+	// bcrypt ignores everything after the first 72 bytes
+	maxBcryptPasswordLength = 72
+)
+
+// PasswordPolicy is the set of rules a new password must follow
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:    8,
+		MaxLength:    maxBcryptPasswordLength,
+		RequireDigit: true,
+	}
+}
+
+// Validate returns an error describing the first rule the password breaks
+func (policy PasswordPolicy) Validate(password string) error {
+	if len(password) < policy.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", policy.MinLength)
+	}
+
+	maxLength := policy.MaxLength
+	if maxLength <= 0 || maxLength > maxBcryptPasswordLength {
+		maxLength = maxBcryptPasswordLength
+	}
+	if len(password) > maxLength {
+		return fmt.Errorf("password must be at most %d bytes long", maxLength)
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+
+	switch {
+	case policy.RequireUpper && !hasUpper:
+		return errors.New("password must contain an uppercase letter")
+	case policy.RequireLower && !hasLower:
+		return errors.New("password must contain a lowercase letter")
+	case policy.RequireDigit && !hasDigit:
+		return errors.New("password must contain a digit")
+	case policy.RequireSymbol && !hasSymbol:
+		return errors.New("password must contain a symbol")
+	}
+
+	return nil
+}
+
+func (svc *UserService) hashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), svc.bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashedPassword), nil
+}
+
+func checkPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
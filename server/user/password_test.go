@@ -0,0 +1,44 @@
+package grpc_user
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:     8,
+		MaxLength:     16,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+	}
+
+	tests := map[string]bool{
+		"Siuuu2025!":           true,
+		"Siu2!":                false,
+		"Siuuu2025!Siuuu2025!": false,
+		"siuuu2025!":           false,
+		"SIUUU2025!":           false,
+		"Siuuuuuuu!":           false,
+		"Siuuu2025a":           false,
+	}
+
+	for password, valid := range tests {
+		t.Run(password, func(t *testing.T) {
+			err := policy.Validate(password)
+			if valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+
+	t.Run("Default Policy", func(t *testing.T) {
+		require.NoError(t, DefaultPasswordPolicy().Validate("word5678"))
+		require.Error(t, DefaultPasswordPolicy().Validate("password"))
+	})
+}
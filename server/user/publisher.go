@@ -0,0 +1,166 @@
+package grpc_user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	DefaultTopic = "user-topic"
+)
+
+type Message struct {
+	Event string `json:"event"`
+	// Key is the Kafka message key, the events of a user share one so they
+	// stay in order on the same partition
+	Key   string `json:"-"`
+	Value any    `json:"value"`
+}
+
+// EventPublisher delivers the events emitted by UserService
+type EventPublisher interface {
+	Publish(ctx context.Context, message Message) error
+}
+
+// BatchPublisher is an EventPublisher that can deliver several events in one
+// call, the OutboxRelay uses it when the publisher implements it
+type BatchPublisher interface {
+	EventPublisher
+	// PublishBatch returns the error of each message, nil for the delivered ones
+	PublishBatch(ctx context.Context, messages []Message) []error
+}
+
+// KafkaPublisher sends events as JSON to a Kafka topic
+type KafkaPublisher struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func NewKafkaPublisher(producer sarama.SyncProducer, topic string) *KafkaPublisher {
+	if topic == "" {
+		topic = DefaultTopic
+	}
+	return &KafkaPublisher{producer: producer, topic: topic}
+}
+
+func (pub *KafkaPublisher) Publish(ctx context.Context, message Message) error {
+	serializedMessage, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic: pub.topic,
+		Key:   messageKey(message),
+		Value: sarama.ByteEncoder(serializedMessage),
+	}
+	partition, offset, err := pub.producer.SendMessage(msg)
+	if err != nil {
+		return err
+	}
+	log.Printf("Message sent to topic(%s)/partition(%d)/offset(%d)\n", pub.topic, partition, offset)
+
+	return nil
+}
+
+func (pub *KafkaPublisher) PublishBatch(ctx context.Context, messages []Message) []error {
+	errs := make([]error, len(messages))
+	var msgs []*sarama.ProducerMessage
+	for i, message := range messages {
+		serializedMessage, err := json.Marshal(message)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		msgs = append(msgs, &sarama.ProducerMessage{
+			Topic:    pub.topic,
+			Key:      messageKey(message),
+			Value:    sarama.ByteEncoder(serializedMessage),
+			Metadata: i,
+		})
+	}
+	if len(msgs) == 0 {
+		return errs
+	}
+
+	err := pub.producer.SendMessages(msgs)
+	var producerErrs sarama.ProducerErrors
+	switch {
+	case err == nil:
+	case errors.As(err, &producerErrs):
+		for _, producerErr := range producerErrs {
+			errs[producerErr.Msg.Metadata.(int)] = producerErr.Err
+		}
+	default:
+		for _, msg := range msgs {
+			errs[msg.Metadata.(int)] = err
+		}
+	}
+	sent := 0
+	for _, msg := range msgs {
+		if errs[msg.Metadata.(int)] == nil {
+			sent++
+		}
+	}
+	log.Printf("Messages sent to topic(%s): %d\n", pub.topic, sent)
+
+	return errs
+}
+
+// messageKey is nil without a key, which lets the producer pick any partition
+func messageKey(message Message) sarama.Encoder {
+	if message.Key == "" {
+		return nil
+	}
+	return sarama.StringEncoder(message.Key)
+}
+
+// RecordingPublisher keeps every published event in memory, meant for tests
+type RecordingPublisher struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewRecordingPublisher() *RecordingPublisher {
+	return &RecordingPublisher{}
+}
+
+func (pub *RecordingPublisher) Publish(ctx context.Context, message Message) error {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+
+	pub.messages = append(pub.messages, message)
+	return nil
+}
+
+// Messages returns a copy of the events published so far
+func (pub *RecordingPublisher) Messages() []Message {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+
+	return append([]Message(nil), pub.messages...)
+}
+
+// Events returns the event names published so far, in order
+func (pub *RecordingPublisher) Events() []string {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+
+	events := make([]string, len(pub.messages))
+	for i, message := range pub.messages {
+		events[i] = message.Event
+	}
+	return events
+}
+
+// NoopPublisher drops every event, for deployments without a message broker
+type NoopPublisher struct{}
+
+func (NoopPublisher) Publish(ctx context.Context, message Message) error {
+	return nil
+}
@@ -0,0 +1,91 @@
+package grpc_user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/IBM/sarama"
+	sarama_mock "github.com/IBM/sarama/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaPublisher(t *testing.T) {
+	mock_producer := sarama_mock.NewSyncProducer(t, sarama.NewConfig())
+	defer mock_producer.Close()
+
+	publisher := NewKafkaPublisher(mock_producer, "")
+
+	t.Run("Publish", func(t *testing.T) {
+		mock_producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			if msg.Topic != DefaultTopic {
+				return errors.New("unexpected topic " + msg.Topic)
+			}
+
+			value, err := msg.Value.Encode()
+			if err != nil {
+				return err
+			}
+
+			var message Message
+			if err := json.Unmarshal(value, &message); err != nil {
+				return err
+			}
+			if message.Event != "user.delete" || message.Value != "86f9f466-851a-4b93-af21-d5f52ac91006" {
+				return errors.New("unexpected message " + string(value))
+			}
+			return nil
+		})
+
+		err := publisher.Publish(context.Background(), Message{Event: "user.delete", Value: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.NoError(t, err)
+	})
+
+	t.Run("Publish With Key", func(t *testing.T) {
+		mock_producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			key, err := msg.Key.Encode()
+			if err != nil {
+				return err
+			}
+			if string(key) != "86f9f466-851a-4b93-af21-d5f52ac91006" {
+				return errors.New("unexpected key " + string(key))
+			}
+			return nil
+		})
+
+		err := publisher.Publish(context.Background(), Message{Event: "user.update", Key: "86f9f466-851a-4b93-af21-d5f52ac91006", Value: "{}"})
+		require.NoError(t, err)
+	})
+
+	t.Run("Publish Failure", func(t *testing.T) {
+		mock_producer.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+
+		err := publisher.Publish(context.Background(), Message{Event: "user.delete", Value: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.ErrorIs(t, err, sarama.ErrOutOfBrokers)
+	})
+
+	t.Run("Publish Batch", func(t *testing.T) {
+		mock_producer.ExpectSendMessageAndSucceed()
+		mock_producer.ExpectSendMessageAndSucceed()
+
+		errs := publisher.PublishBatch(context.Background(), []Message{
+			{Event: "user.created", Value: "86f9f466-851a-4b93-af21-d5f52ac91006"},
+			{Event: "user.created", Value: "4bedafd6-b946-4d70-a156-d828ddcb62fb"},
+		})
+		require.Equal(t, []error{nil, nil}, errs)
+	})
+
+	t.Run("Publish Batch Failure", func(t *testing.T) {
+		mock_producer.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+
+		errs := publisher.PublishBatch(context.Background(), []Message{
+			{Event: "user.created", Value: "86f9f466-851a-4b93-af21-d5f52ac91006"},
+			{Event: "user.created", Value: func() {}},
+		})
+		require.ErrorIs(t, errs[0], sarama.ErrOutOfBrokers)
+		// the message that can't be serialized isn't sent at all
+		require.Error(t, errs[1])
+		require.NotErrorIs(t, errs[1], sarama.ErrOutOfBrokers)
+	})
+}
@@ -0,0 +1,102 @@
+package grpc_user
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// DefaultPurgeRetention is how long deleted users can be restored
+const DefaultPurgeRetention = 30 * 24 * time.Hour
+
+// UserPurger removes for good the users deleted longer than Retention ago,
+// emitting a user.purged event for each
+type UserPurger struct {
+	service *UserService
+	now     func() time.Time
+
+	Retention time.Duration
+	Interval  time.Duration
+	BatchSize int
+}
+
+func NewUserPurger(service *UserService, retention time.Duration) *UserPurger {
+	return &UserPurger{
+		service:   service,
+		now:       time.Now,
+		Retention: retention,
+		Interval:  time.Hour,
+		BatchSize: 100,
+	}
+}
+
+// Run purges every Interval until ctx is cancelled
+func (purger *UserPurger) Run(ctx context.Context) {
+	ticker := time.NewTicker(purger.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := purger.PurgeOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("User purge failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeOnce purges every user past the retention and returns how many were purged
+func (purger *UserPurger) PurgeOnce(ctx context.Context) (int, error) {
+	deletedBefore := storeTime(purger.now().Add(-purger.Retention))
+
+	purged := 0
+	for {
+		batch, err := purger.service.purgeDeleted(ctx, deletedBefore, purger.BatchSize)
+		purged += batch
+		if err != nil || batch < purger.BatchSize {
+			return purged, err
+		}
+	}
+}
+
+// purgeDeleted purges up to limit users deleted before deletedBefore, users
+// restored in the meantime are skipped by the repository
+func (svc *UserService) purgeDeleted(ctx context.Context, deletedBefore time.Time, limit int) (int, error) {
+	users, err := svc.repository.List(ctx, ListQuery{
+		Filter: Condition{Field: "deleted_at", Op: OpLess, Value: timeKey(deletedBefore)},
+		Sort:   []SortField{{Field: "deleted_at"}, {Field: "id"}},
+		Limit:  int64(limit),
+		Fields: []string{"id", "deleted_at"},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, user := range users {
+		events, err := svc.outboxEvents("user.purged", user.Id, userPurgedEvent{
+			Id:       user.Id,
+			PurgedAt: formatTime(time.Now()),
+		})
+		if err != nil {
+			return purged, err
+		}
+
+		err = svc.repository.Purge(ctx, user.Id, deletedBefore, events...)
+		if errors.Is(err, ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+
+		log.Printf("User Purged:  %v", user.Id)
+		purged++
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,139 @@
+package grpc_user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSoftDelete(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	for _, user := range []*UserRecord{
+		{Id: "a", FirstName: "Cristiano", Nickname: "CR7", Email: "cristiano@ronaldo.com", CreatedAt: testTime("2025-01-10T10:00:00Z"), Version: 1},
+		{Id: "b", FirstName: "Mohammed", Nickname: "MoSalah", Email: "mo@salah.com", CreatedAt: testTime("2025-02-10T10:00:00Z"), Version: 1},
+	} {
+		require.NoError(t, user_repository.Create(ctx, user))
+	}
+	publisher := NewRecordingPublisher()
+	svc := NewUserService(user_repository, publisher)
+
+	code := func(err error) codes.Code {
+		return status.Code(err)
+	}
+
+	t.Run("Delete Hides The User", func(t *testing.T) {
+		_, err := svc.DeleteUser(ctx, &pb.DeleteUserRequest{Id: "a"})
+		require.NoError(t, err)
+
+		_, err = svc.GetUser(ctx, &pb.GetUserRequest{Id: "a"})
+		require.Equal(t, codes.NotFound, code(err))
+
+		deleted, err := svc.GetUser(ctx, &pb.GetUserRequest{Id: "a", ShowDeleted: true})
+		require.NoError(t, err)
+		require.NotNil(t, deleted.DeletedAt)
+		require.Equal(t, int64(2), deleted.Version)
+
+		list, err := svc.ListUsers(ctx, &pb.ListUsersRequest{})
+		require.NoError(t, err)
+		require.Len(t, list.Users, 1)
+		require.Equal(t, int32(1), list.TotalCount)
+
+		list, err = svc.ListUsers(ctx, &pb.ListUsersRequest{ShowDeleted: true, Filter: `deleted_at:*`})
+		require.NoError(t, err)
+		require.Len(t, list.Users, 1)
+		require.Equal(t, "a", list.Users[0].Id)
+
+		search, err := svc.SearchUsers(ctx, &pb.SearchUsersRequest{Query: "cristiano"})
+		require.NoError(t, err)
+		require.Empty(t, search.Results)
+	})
+
+	t.Run("Deleted Users Can't Change", func(t *testing.T) {
+		_, err := svc.DeleteUser(ctx, &pb.DeleteUserRequest{Id: "a"})
+		require.Equal(t, codes.NotFound, code(err))
+
+		newNickname := "Cris"
+		_, err = svc.UpdateUser(ctx, &pb.UpdateUserRequest{Id: "a", Nickname: &newNickname})
+		require.Equal(t, codes.NotFound, code(err))
+
+		_, err = svc.AssignRole(ctx, &pb.AssignRoleRequest{Id: "a", Role: SupportRole})
+		require.Equal(t, codes.NotFound, code(err))
+
+		// the email stays taken so the user can be restored
+		_, err = svc.CreateUser(ctx, &pb.CreateUserRequest{FirstName: "Cristiano", LastName: "Ronaldo", Nickname: "Cris", Email: "cristiano@ronaldo.com", Country: "PT", Password: "Password123"})
+		require.Equal(t, codes.AlreadyExists, code(err))
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		restored, err := svc.RestoreUser(ctx, &pb.RestoreUserRequest{Id: "a"})
+		require.NoError(t, err)
+		require.Nil(t, restored.DeletedAt)
+		require.Equal(t, int64(3), restored.Version)
+
+		_, err = svc.GetUser(ctx, &pb.GetUserRequest{Id: "a"})
+		require.NoError(t, err)
+
+		_, err = svc.RestoreUser(ctx, &pb.RestoreUserRequest{Id: "a"})
+		require.Equal(t, codes.FailedPrecondition, code(err))
+
+		_, err = svc.RestoreUser(ctx, &pb.RestoreUserRequest{Id: "unknown"})
+		require.Equal(t, codes.NotFound, code(err))
+	})
+
+	t.Run("Purge After Retention", func(t *testing.T) {
+		_, err := svc.DeleteUser(ctx, &pb.DeleteUserRequest{Id: "b"})
+		require.NoError(t, err)
+
+		purger := NewUserPurger(svc, 24*time.Hour)
+		purged, err := purger.PurgeOnce(ctx)
+		require.NoError(t, err)
+		require.Zero(t, purged)
+
+		purger.now = func() time.Time { return time.Now().Add(25 * time.Hour) }
+		purger.BatchSize = 1
+		purged, err = purger.PurgeOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, purged)
+
+		_, err = svc.GetUser(ctx, &pb.GetUserRequest{Id: "b", ShowDeleted: true})
+		require.Equal(t, codes.NotFound, code(err))
+		_, err = svc.RestoreUser(ctx, &pb.RestoreUserRequest{Id: "b"})
+		require.Equal(t, codes.NotFound, code(err))
+
+		// only deleted users are purged
+		_, err = svc.GetUser(ctx, &pb.GetUserRequest{Id: "a"})
+		require.NoError(t, err)
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		relay := NewOutboxRelay(user_repository, publisher)
+		_, err := relay.RelayOnce(ctx)
+		require.NoError(t, err)
+
+		require.Equal(t, []string{
+			"user.deleted",
+			"user.restored",
+			"user.deleted",
+			"user.purged",
+		}, publisher.Events())
+	})
+
+	t.Run("MongoDB Filters", func(t *testing.T) {
+		require.Equal(t, bson.M{"deleted_at": bson.M{"$in": bson.A{nil, ""}}}, mongoFilter(visibleUsers(nil, false)))
+		require.Nil(t, visibleUsers(nil, true))
+
+		set, unset, err := setFields(&UserRecord{Id: "a", UpdatedAt: testTime("2025-03-22T18:37:00Z"), Version: 3}, []string{"deleted_at"})
+		require.NoError(t, err)
+		require.Equal(t, bson.M{"updated_at": primitive.NewDateTimeFromTime(testTime("2025-03-22T18:37:00Z")), "version": int64(3)}, set)
+		require.Equal(t, bson.M{"deleted_at": ""}, unset)
+	})
+}
@@ -0,0 +1,58 @@
+package grpc_user
+
+import (
+	"slices"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+// derivedFields are User fields that aren't stored but built from other ones
+var derivedFields = map[string]string{
+	"permissions":       "roles",
+	"legacy_created_at": "created_at",
+	"legacy_updated_at": "updated_at",
+}
+
+func validateReadMask(v *violations, field string, mask *fieldmaskpb.FieldMask) {
+	fields := (&pb.User{}).ProtoReflect().Descriptor().Fields()
+	for _, path := range mask.GetPaths() {
+		if fields.ByName(protoreflect.Name(path)) == nil {
+			v.add(field, "unknown field %q", path)
+		}
+	}
+}
+
+// readFields returns the stored fields needed to answer with the masked User
+// fields, nil means all of them
+func readFields(mask *fieldmaskpb.FieldMask) []string {
+	var fields []string
+	for _, path := range mask.GetPaths() {
+		field := path
+		if stored, ok := derivedFields[path]; ok {
+			field = stored
+		}
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// pruneUser clears the fields that aren't in the mask, an empty mask keeps all
+func pruneUser(user *pb.User, mask *fieldmaskpb.FieldMask) *pb.User {
+	if len(mask.GetPaths()) == 0 {
+		return user
+	}
+
+	message := user.ProtoReflect()
+	message.Range(func(field protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		if !slices.Contains(mask.Paths, string(field.Name())) {
+			message.Clear(field)
+		}
+		return true
+	})
+	return user
+}
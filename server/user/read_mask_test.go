@@ -0,0 +1,113 @@
+package grpc_user
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func TestReadMask(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	user_repository.Create(ctx, &UserRecord{
+		Id:           "86f9f466-851a-4b93-af21-d5f52ac91006",
+		FirstName:    "Cristiano",
+		LastName:     "Ronaldo",
+		Nickname:     "CR7",
+		PasswordHash: "$2a$14$ol2a598AAUFAV3SizmaZJuvnBjfqA6CGzssNnCQ0Wn9Sr7vFxy5wy",
+		Email:        "cristiano@ronaldo.com",
+		Country:      "PT",
+		CreatedAt:    testTime("2025-03-22T18:37:00Z"),
+		UpdatedAt:    testTime("2025-03-22T18:37:00Z"),
+		Roles:        []string{SupportRole},
+		Version:      1,
+	})
+	user_repository.Create(ctx, &UserRecord{
+		Id:        "4bedafd6-b946-4d70-a156-d828ddcb62fb",
+		FirstName: "Mohammed",
+		LastName:  "Salah",
+		Nickname:  "MoSalah",
+		Email:     "mo@salah.com",
+		Country:   "EG",
+		CreatedAt: testTime("2025-03-23T10:00:00Z"),
+		UpdatedAt: testTime("2025-03-23T10:00:00Z"),
+		Version:   1,
+	})
+
+	publisher := NewRecordingPublisher()
+	svc := NewUserService(user_repository, publisher, WithEventPolicy("user.list", EventPolicy{Mode: DeliverySync}))
+
+	t.Run("Get User With Mask", func(t *testing.T) {
+		resp, err := svc.GetUser(ctx, &pb.GetUserRequest{
+			Id:       "86f9f466-851a-4b93-af21-d5f52ac91006",
+			ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"id", "nickname"}},
+		})
+		require.NoError(t, err)
+		require.Equal(t, "86f9f466-851a-4b93-af21-d5f52ac91006", resp.Id)
+		require.Equal(t, "CR7", resp.Nickname)
+		require.Empty(t, resp.Email)
+		require.Nil(t, resp.CreatedAt)
+		require.Empty(t, resp.LegacyCreatedAt)
+		require.Zero(t, resp.Version)
+	})
+
+	t.Run("Permissions Are Resolved From Roles", func(t *testing.T) {
+		resp, err := svc.GetUser(ctx, &pb.GetUserRequest{
+			Id:       "86f9f466-851a-4b93-af21-d5f52ac91006",
+			ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"permissions"}},
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{PermissionUsersRead, PermissionUsersList}, resp.Permissions)
+		require.Empty(t, resp.Roles)
+	})
+
+	t.Run("Unknown Path", func(t *testing.T) {
+		_, err := svc.GetUser(ctx, &pb.GetUserRequest{
+			Id:       "86f9f466-851a-4b93-af21-d5f52ac91006",
+			ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"password"}},
+		})
+		require.Equal(t, []string{"read_mask"}, fieldViolations(t, err))
+
+		_, err = svc.ListUsers(ctx, &pb.ListUsersRequest{
+			Page:     1,
+			PageSize: 10,
+			ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"nickname", "shoe_size"}},
+		})
+		require.Equal(t, []string{"read_mask"}, fieldViolations(t, err))
+	})
+
+	t.Run("List Users With Mask", func(t *testing.T) {
+		resp, err := svc.ListUsers(ctx, &pb.ListUsersRequest{
+			Page:     1,
+			PageSize: 10,
+			ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"id", "nickname"}},
+		})
+		require.NoError(t, err)
+		require.Len(t, resp.Users, 2)
+		for _, user := range resp.Users {
+			require.NotEmpty(t, user.Id)
+			require.NotEmpty(t, user.Nickname)
+			require.Empty(t, user.FirstName)
+			require.Empty(t, user.Country)
+		}
+
+		// the event carries the pruned users too
+		require.Equal(t, []string{"user.list"}, publisher.Events())
+		published := publisher.Messages()[0].Value.([]*userEvent)
+		require.Empty(t, published[0].Email)
+	})
+
+	t.Run("Repository Projection", func(t *testing.T) {
+		user, err := user_repository.Get(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006", "nickname")
+		require.NoError(t, err)
+		require.Equal(t, &UserRecord{Nickname: "CR7"}, user)
+
+		users, err := user_repository.List(ctx, ListQuery{Fields: []string{"country"}})
+		require.NoError(t, err)
+		require.Equal(t, []*UserRecord{{Country: "PT"}, {Country: "EG"}}, users)
+	})
+}
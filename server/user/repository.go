@@ -0,0 +1,107 @@
+package grpc_user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	// ErrVersionConflict is returned when the user changed since it was read
+	ErrVersionConflict = errors.New("user was modified concurrently")
+)
+
+// DuplicateError is returned when a write would give a user the email or
+// nickname of another user
+type DuplicateError struct {
+	Field string
+}
+
+func (err *DuplicateError) Error() string {
+	return fmt.Sprintf("a user with this %s already exists", err.Field)
+}
+
+// ListQuery holds the filter, order and paging options used by UserRepository.List
+type ListQuery struct {
+	Filter Filter
+	// Sort is the list order, it must end with a unique field so it is stable
+	Sort  []SortField
+	Skip  int64
+	Limit int64
+	// After only lists the users that come after the cursor
+	After *Cursor
+	// Fields are the bson fields to load, all of them if empty
+	Fields []string
+}
+
+func (query ListQuery) sort() []SortField {
+	if len(query.Sort) == 0 {
+		return defaultSort
+	}
+	return query.Sort
+}
+
+// SearchQuery holds the words and paging options used by UserRepository.Search
+type SearchQuery struct {
+	// Terms are lowercased words, see searchTerms
+	Terms []string
+	// Filter must also match, nil matches every user
+	Filter Filter
+	Skip   int64
+	Limit  int64
+	// Fields are the bson fields to load, all of them if empty
+	Fields []string
+}
+
+// SearchHit is a user found by Search with its relevance
+type SearchHit struct {
+	User  *UserRecord
+	Score float64
+}
+
+// UserRepository is the storage backend used by UserService.
+// The events given to a write are stored in the outbox atomically with it.
+// Deleting a user is an Update of deleted_at, Purge removes it for good.
+// Writes fail with a DuplicateError when the email or nickname is taken.
+// Update only writes the user if the stored version is user.Version - 1, so
+// callers read the user, increment its version and write it back. It sets the
+// given bson fields plus updated_at and version, the rest of the stored user is
+// left as is. Empty omitempty fields like deleted_at are removed.
+type UserRepository interface {
+	Create(ctx context.Context, user *UserRecord, events ...*OutboxMessage) error
+	// CreateMany creates each user with its events like Create, errs[i] is why
+	// users[i] wasn't created and doesn't stop the others. The error is for
+	// failures of the whole batch.
+	CreateMany(ctx context.Context, users []*UserRecord, events [][]*OutboxMessage) (errs []error, err error)
+	// Get loads the named bson fields of the user, all of them if none are given
+	Get(ctx context.Context, id string, fields ...string) (*UserRecord, error)
+	// GetMany loads the named bson fields of the users with the ids, ids without
+	// a user are left out and the order is unspecified
+	GetMany(ctx context.Context, ids []string, fields ...string) ([]*UserRecord, error)
+	// FindByLogin returns the user whose email or nickname matches login
+	FindByLogin(ctx context.Context, login string) (*UserRecord, error)
+	// CheckUnique returns a DuplicateError if a user other than id has the email or nickname
+	CheckUnique(ctx context.Context, id string, email string, nickname string) error
+	// FindTaken returns the users holding any of the emails or nicknames with
+	// only those two fields, batches check all of theirs in one query
+	FindTaken(ctx context.Context, emails []string, nicknames []string) ([]*UserRecord, error)
+	Update(ctx context.Context, user *UserRecord, fields []string, events ...*OutboxMessage) (*UserRecord, error)
+	// Purge removes the user if it was deleted before deletedBefore, otherwise it
+	// returns ErrUserNotFound
+	Purge(ctx context.Context, id string, deletedBefore time.Time, events ...*OutboxMessage) error
+	List(ctx context.Context, query ListQuery) ([]*UserRecord, error)
+	// Export calls fn with each user List would return, reading them as fn asks
+	// for them. It isn't a point in time read, a user changed during the export
+	// is exported as it was when its page was read. It stops at the first error
+	// of fn.
+	Export(ctx context.Context, query ListQuery, fn func(*UserRecord) error) error
+	Count(ctx context.Context, filter Filter) (int64, error)
+	// EstimatedCount returns the number of users from the collection metadata,
+	// it is cheap but may be off after unclean shutdowns
+	EstimatedCount(ctx context.Context) (int64, error)
+	// Search returns the users matching any of the terms, best matches first and
+	// ties by id
+	Search(ctx context.Context, query SearchQuery) ([]*SearchHit, error)
+}
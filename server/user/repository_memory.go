@@ -0,0 +1,448 @@
+package grpc_user
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// InMemoryUserRepository is a thread-safe UserRepository kept in process memory,
+// meant for tests and for running the service without MongoDB
+type InMemoryUserRepository struct {
+	mu    sync.RWMutex
+	users map[string]*UserRecord
+	order []string
+	// outbox holds the undelivered messages oldest first, delivered ones are
+	// dropped right away
+	outbox     []*OutboxMessage
+	outboxById map[string]*OutboxMessage
+	search     SearchIndex
+}
+
+type InMemoryOption func(*InMemoryUserRepository)
+
+// WithSearchIndex replaces the PrefixIndex used by Search
+func WithSearchIndex(index SearchIndex) InMemoryOption {
+	return func(repo *InMemoryUserRepository) {
+		repo.search = index
+	}
+}
+
+func NewInMemoryUserRepository(opts ...InMemoryOption) *InMemoryUserRepository {
+	repo := &InMemoryUserRepository{
+		users:      make(map[string]*UserRecord),
+		outboxById: make(map[string]*OutboxMessage),
+		search:     NewPrefixIndex(),
+	}
+	for _, opt := range opts {
+		opt(repo)
+	}
+	return repo
+}
+
+func (repo *InMemoryUserRepository) Create(ctx context.Context, user *UserRecord, events ...*OutboxMessage) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if err := repo.checkUnique(user.Id, user.Email, user.Nickname); err != nil {
+		return err
+	}
+
+	if _, ok := repo.users[user.Id]; !ok {
+		repo.order = append(repo.order, user.Id)
+	}
+	repo.users[user.Id] = user.clone()
+	repo.search.Put(user)
+	repo.appendOutbox(events)
+
+	return nil
+}
+
+func (repo *InMemoryUserRepository) CreateMany(ctx context.Context, users []*UserRecord, events [][]*OutboxMessage) ([]error, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	errs := make([]error, len(users))
+	for i, user := range users {
+		if err := repo.checkUnique(user.Id, user.Email, user.Nickname); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		if _, ok := repo.users[user.Id]; !ok {
+			repo.order = append(repo.order, user.Id)
+		}
+		repo.users[user.Id] = user.clone()
+		repo.search.Put(user)
+		repo.appendOutbox(events[i])
+	}
+
+	return errs, nil
+}
+
+func (repo *InMemoryUserRepository) Get(ctx context.Context, id string, fields ...string) (*UserRecord, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	user, ok := repo.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	if len(fields) > 0 {
+		return user.project(fields)
+	}
+	return user.clone(), nil
+}
+
+func (repo *InMemoryUserRepository) GetMany(ctx context.Context, ids []string, fields ...string) ([]*UserRecord, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	var users []*UserRecord
+	found := make(map[string]bool)
+	for _, id := range ids {
+		user, ok := repo.users[id]
+		if !ok || found[id] {
+			continue
+		}
+		found[id] = true
+
+		if len(fields) > 0 {
+			projected, err := user.project(fields)
+			if err != nil {
+				return nil, err
+			}
+			// the caller needs the id to match users to ids
+			projected.Id = user.Id
+			users = append(users, projected)
+			continue
+		}
+		users = append(users, user.clone())
+	}
+	return users, nil
+}
+
+func (repo *InMemoryUserRepository) FindByLogin(ctx context.Context, login string) (*UserRecord, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	if login == "" {
+		return nil, ErrUserNotFound
+	}
+
+	email := normalizeEmail(login)
+	for _, id := range repo.order {
+		user := repo.users[id]
+		if user.Email == email || user.Nickname == login {
+			return user.clone(), nil
+		}
+	}
+
+	return nil, ErrUserNotFound
+}
+
+func (repo *InMemoryUserRepository) CheckUnique(ctx context.Context, id string, email string, nickname string) error {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	return repo.checkUnique(id, email, nickname)
+}
+
+// checkUnique must be called with repo.mu held
+func (repo *InMemoryUserRepository) checkUnique(id string, email string, nickname string) error {
+	for _, user := range repo.users {
+		if user.Id == id {
+			continue
+		}
+		if email != "" && user.Email == email {
+			return &DuplicateError{Field: "email"}
+		}
+		if nickname != "" && user.Nickname == nickname {
+			return &DuplicateError{Field: "nickname"}
+		}
+	}
+	return nil
+}
+
+func (repo *InMemoryUserRepository) FindTaken(ctx context.Context, emails []string, nicknames []string) ([]*UserRecord, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	takenEmails := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		takenEmails[email] = true
+	}
+	takenNicknames := make(map[string]bool, len(nicknames))
+	for _, nickname := range nicknames {
+		takenNicknames[nickname] = true
+	}
+
+	var users []*UserRecord
+	for _, id := range repo.order {
+		user := repo.users[id]
+		if takenEmails[user.Email] || (user.Nickname != "" && takenNicknames[user.Nickname]) {
+			users = append(users, &UserRecord{Email: user.Email, Nickname: user.Nickname})
+		}
+	}
+	return users, nil
+}
+
+func (repo *InMemoryUserRepository) Update(ctx context.Context, user *UserRecord, fields []string, events ...*OutboxMessage) (*UserRecord, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	stored, ok := repo.users[user.Id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if stored.Version != user.Version-1 {
+		return nil, ErrVersionConflict
+	}
+	if err := repo.checkUnique(user.Id, user.Email, user.Nickname); err != nil {
+		return nil, err
+	}
+
+	updated := stored.clone()
+	if err := updated.copyFields(user, fields); err != nil {
+		return nil, err
+	}
+	repo.users[user.Id] = updated
+	repo.search.Put(updated)
+	repo.appendOutbox(events)
+
+	return updated.clone(), nil
+}
+
+func (repo *InMemoryUserRepository) Purge(ctx context.Context, id string, deletedBefore time.Time, events ...*OutboxMessage) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	user, ok := repo.users[id]
+	if !ok || !user.deleted() || !user.DeletedAt.Before(deletedBefore) {
+		return ErrUserNotFound
+	}
+	delete(repo.users, id)
+	repo.search.Remove(id)
+
+	for i, userId := range repo.order {
+		if userId == id {
+			repo.order = append(repo.order[:i], repo.order[i+1:]...)
+			break
+		}
+	}
+	repo.appendOutbox(events)
+
+	return nil
+}
+
+func (repo *InMemoryUserRepository) List(ctx context.Context, query ListQuery) ([]*UserRecord, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	sort := query.sort()
+	var selected []*UserRecord
+	for _, id := range repo.order {
+		user := repo.users[id]
+		if !matchFilter(user, query.Filter) {
+			continue
+		}
+		if query.After != nil && compareKeys(sortKey(user, sort), query.After.Values, sort) <= 0 {
+			continue
+		}
+		selected = append(selected, user)
+	}
+	slices.SortFunc(selected, func(a, b *UserRecord) int {
+		return compareKeys(sortKey(a, sort), sortKey(b, sort), sort)
+	})
+
+	var users []*UserRecord
+	var skipped int64
+	for _, user := range selected {
+		if skipped < query.Skip {
+			skipped++
+			continue
+		}
+		if query.Limit > 0 && int64(len(users)) >= query.Limit {
+			break
+		}
+		if len(query.Fields) > 0 {
+			projected, err := user.project(query.Fields)
+			if err != nil {
+				return nil, err
+			}
+			users = append(users, projected)
+			continue
+		}
+		users = append(users, user.clone())
+	}
+
+	return users, nil
+}
+
+// Export lists the users first, the copies are a snapshot
+func (repo *InMemoryUserRepository) Export(ctx context.Context, query ListQuery, fn func(*UserRecord) error) error {
+	users, err := repo.List(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *InMemoryUserRepository) Count(ctx context.Context, filter Filter) (int64, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	var count int64
+	for _, user := range repo.users {
+		if matchFilter(user, filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (repo *InMemoryUserRepository) EstimatedCount(ctx context.Context) (int64, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	return int64(len(repo.users)), nil
+}
+
+func (repo *InMemoryUserRepository) Search(ctx context.Context, query SearchQuery) ([]*SearchHit, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	var hits []*SearchHit
+	for id, score := range repo.search.Search(query.Terms) {
+		if user, ok := repo.users[id]; ok && matchFilter(user, query.Filter) {
+			hits = append(hits, &SearchHit{User: user, Score: score})
+		}
+	}
+	slices.SortFunc(hits, func(a, b *SearchHit) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.User.Id, b.User.Id)
+	})
+
+	hits = hits[min(query.Skip, int64(len(hits))):]
+	if query.Limit > 0 && int64(len(hits)) > query.Limit {
+		hits = hits[:query.Limit]
+	}
+	for _, hit := range hits {
+		if len(query.Fields) == 0 {
+			hit.User = hit.User.clone()
+			continue
+		}
+		projected, err := hit.User.project(query.Fields)
+		if err != nil {
+			return nil, err
+		}
+		hit.User = projected
+	}
+
+	return hits, nil
+}
+
+func (repo *InMemoryUserRepository) PendingOutbox(ctx context.Context, now time.Time, limit int) ([]*OutboxMessage, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	var messages []*OutboxMessage
+	for _, message := range repo.outbox {
+		if limit > 0 && len(messages) >= limit {
+			break
+		}
+		if message.NextAttemptAt.After(now) {
+			continue
+		}
+		copied := *message
+		messages = append(messages, &copied)
+	}
+
+	return messages, nil
+}
+
+func (repo *InMemoryUserRepository) ClaimOutbox(ctx context.Context, owner string, now time.Time, leaseUntil time.Time, limit int) ([]*OutboxMessage, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	// a key is blocked by its oldest message that can't be claimed now
+	blocked := make(map[string]bool)
+	var messages []*OutboxMessage
+	for _, message := range repo.outbox {
+		if limit > 0 && len(messages) >= limit {
+			break
+		}
+		if blocked[message.Key] {
+			continue
+		}
+		leased := message.LeaseOwner != owner && message.LeaseExpiresAt != nil && message.LeaseExpiresAt.After(now)
+		if leased || message.NextAttemptAt.After(now) {
+			if message.Key != "" {
+				blocked[message.Key] = true
+			}
+			continue
+		}
+
+		message.LeaseOwner = owner
+		message.LeaseExpiresAt = &leaseUntil
+		copied := *message
+		messages = append(messages, &copied)
+	}
+
+	return messages, nil
+}
+
+func (repo *InMemoryUserRepository) MarkDelivered(ctx context.Context, id string, deliveredAt time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	message, ok := repo.outboxById[id]
+	if !ok {
+		return nil
+	}
+	delete(repo.outboxById, id)
+	// the relay delivers the oldest messages, they are at the front
+	if i := slices.Index(repo.outbox, message); i >= 0 {
+		repo.outbox = slices.Delete(repo.outbox, i, i+1)
+	}
+
+	return nil
+}
+
+func (repo *InMemoryUserRepository) MarkFailed(ctx context.Context, id string, nextAttemptAt time.Time, lastError string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if message, ok := repo.outboxById[id]; ok {
+		message.Attempts++
+		message.NextAttemptAt = nextAttemptAt
+		message.LastError = lastError
+		message.LeaseOwner = ""
+		message.LeaseExpiresAt = nil
+	}
+
+	return nil
+}
+
+// appendOutbox must be called with repo.mu held
+func (repo *InMemoryUserRepository) appendOutbox(events []*OutboxMessage) {
+	for _, event := range events {
+		copied := *event
+		repo.outbox = append(repo.outbox, &copied)
+		repo.outboxById[copied.Id] = &copied
+	}
+}
@@ -0,0 +1,581 @@
+package grpc_user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoUserRepository stores users in a MongoDB collection and their events in
+// the outbox collection of the same database. Writes use multi-document
+// transactions, so MongoDB must run as a replica set.
+type MongoUserRepository struct {
+	collection *mongo.Collection
+	outbox     *mongo.Collection
+}
+
+func NewMongoUserRepository(collection *mongo.Collection) *MongoUserRepository {
+	return &MongoUserRepository{
+		collection: collection,
+		outbox:     collection.Database().Collection(outboxCollection),
+	}
+}
+
+func (repo *MongoUserRepository) Create(ctx context.Context, user *UserRecord, events ...*OutboxMessage) error {
+	err := repo.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+		if _, err := repo.collection.InsertOne(ctx, searchDocument{UserRecord: *user, SearchPrefixes: searchPrefixes(user)}); err != nil {
+			return err
+		}
+		return repo.insertOutbox(ctx, events)
+	})
+	return duplicateKeyError(err)
+}
+
+func (repo *MongoUserRepository) CreateMany(ctx context.Context, users []*UserRecord, events [][]*OutboxMessage) ([]error, error) {
+	errs := make([]error, len(users))
+	pending := make([]int, len(users))
+	for i := range users {
+		pending[i] = i
+	}
+
+	// a write error aborts the whole transaction, so the users that failed are
+	// left out and the others inserted again until none fails
+	for len(pending) > 0 {
+		var failed []mongo.BulkWriteError
+		err := repo.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+			failed = nil
+			documents := make([]any, len(pending))
+			var outbox []*OutboxMessage
+			for i, index := range pending {
+				documents[i] = searchDocument{UserRecord: *users[index], SearchPrefixes: searchPrefixes(users[index])}
+				outbox = append(outbox, events[index]...)
+			}
+
+			_, err := repo.collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+			var bulkErr mongo.BulkWriteException
+			if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+				failed = bulkErr.WriteErrors
+			}
+			if err != nil {
+				return err
+			}
+			return repo.insertOutbox(ctx, outbox)
+		})
+		if err == nil {
+			return errs, nil
+		}
+		if len(failed) == 0 {
+			return nil, err
+		}
+
+		var remaining []int
+		for i, index := range pending {
+			j := slices.IndexFunc(failed, func(writeErr mongo.BulkWriteError) bool { return writeErr.Index == i })
+			if j < 0 {
+				remaining = append(remaining, index)
+				continue
+			}
+			errs[index] = duplicateKeyError(mongo.BulkWriteException{WriteErrors: failed[j : j+1]})
+		}
+		pending = remaining
+	}
+
+	return errs, nil
+}
+
+func (repo *MongoUserRepository) Get(ctx context.Context, id string, fields ...string) (*UserRecord, error) {
+	opts := options.FindOne()
+	if len(fields) > 0 {
+		opts.SetProjection(projection(fields))
+	}
+
+	var user UserRecord
+	err := repo.collection.FindOne(ctx, bson.M{"id": id}, opts).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (repo *MongoUserRepository) GetMany(ctx context.Context, ids []string, fields ...string) ([]*UserRecord, error) {
+	opts := options.Find()
+	if len(fields) > 0 {
+		// the caller needs the id to match users to ids
+		if !slices.Contains(fields, "id") {
+			fields = append(slices.Clone(fields), "id")
+		}
+		opts.SetProjection(projection(fields))
+	}
+
+	cursor, err := repo.collection.Find(ctx, bson.M{"id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var users []*UserRecord
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (repo *MongoUserRepository) FindByLogin(ctx context.Context, login string) (*UserRecord, error) {
+	if login == "" {
+		return nil, ErrUserNotFound
+	}
+
+	var user UserRecord
+	err := repo.collection.FindOne(ctx, bson.M{
+		"$or": bson.A{
+			bson.M{"email": normalizeEmail(login)},
+			bson.M{"nickname": login},
+		},
+	}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (repo *MongoUserRepository) CheckUnique(ctx context.Context, id string, email string, nickname string) error {
+	// users without a nickname don't conflict with each other
+	taken := bson.A{bson.M{"email": email}}
+	if nickname != "" {
+		taken = append(taken, bson.M{"nickname": nickname})
+	}
+
+	var user UserRecord
+	err := repo.collection.FindOne(ctx, bson.M{
+		"id":  bson.M{"$ne": id},
+		"$or": taken,
+	}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}
+
+	if user.Email == email {
+		return &DuplicateError{Field: "email"}
+	}
+	return &DuplicateError{Field: "nickname"}
+}
+
+func (repo *MongoUserRepository) FindTaken(ctx context.Context, emails []string, nicknames []string) ([]*UserRecord, error) {
+	taken := bson.A{bson.M{"email": bson.M{"$in": emails}}}
+	if len(nicknames) > 0 {
+		taken = append(taken, bson.M{"nickname": bson.M{"$in": nicknames}})
+	}
+
+	opts := options.Find().SetProjection(projection([]string{"email", "nickname"}))
+	cursor, err := repo.collection.Find(ctx, bson.M{"$or": taken}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var users []*UserRecord
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (repo *MongoUserRepository) Update(ctx context.Context, user *UserRecord, fields []string, events ...*OutboxMessage) (*UserRecord, error) {
+	set, unset, err := setFields(user, fields)
+	if err != nil {
+		return nil, err
+	}
+	if isSearched(fields) {
+		set["search_prefixes"] = searchPrefixes(user)
+	}
+
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	var updatedUser UserRecord
+	err = repo.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+		err := repo.collection.FindOneAndUpdate(
+			ctx,
+			bson.M{"id": user.Id, "version": user.Version - 1},
+			update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&updatedUser)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return repo.missingOrStale(ctx, user.Id)
+			}
+			return err
+		}
+		return repo.insertOutbox(ctx, events)
+	})
+	if err != nil {
+		return nil, duplicateKeyError(err)
+	}
+
+	return &updatedUser, nil
+}
+
+// projection only loads the named fields, without the mongo _id
+func projection(fields []string) bson.D {
+	projection := bson.D{{Key: "_id", Value: 0}}
+	for _, field := range fields {
+		projection = append(projection, bson.E{Key: field, Value: 1})
+	}
+	return projection
+}
+
+// setFields picks the named fields of the encoded user for $set, updated_at and
+// version are always included. Fields omitted because they are empty go to $unset.
+func setFields(user *UserRecord, fields []string) (bson.M, bson.M, error) {
+	data, err := bson.Marshal(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var document bson.M
+	if err := bson.Unmarshal(data, &document); err != nil {
+		return nil, nil, err
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+	for _, field := range slices.Concat(fields, []string{"updated_at", "version"}) {
+		if field == "id" || (&UserRecord{}).copyField(user, field) != nil {
+			return nil, nil, fmt.Errorf("field %q can't be updated", field)
+		}
+		if value, ok := document[field]; ok {
+			set[field] = value
+		} else {
+			unset[field] = ""
+		}
+	}
+	return set, unset, nil
+}
+
+// missingOrStale tells apart why a conditional update matched nothing
+func (repo *MongoUserRepository) missingOrStale(ctx context.Context, id string) error {
+	count, err := repo.collection.CountDocuments(ctx, bson.M{"id": id}, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrUserNotFound
+	}
+	return ErrVersionConflict
+}
+
+func (repo *MongoUserRepository) Purge(ctx context.Context, id string, deletedBefore time.Time, events ...*OutboxMessage) error {
+	return repo.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+		res, err := repo.collection.DeleteOne(ctx, bson.M{
+			"id":         id,
+			"deleted_at": bson.M{"$lt": deletedBefore},
+		})
+		if err != nil {
+			return err
+		}
+
+		if res.DeletedCount == 0 {
+			return ErrUserNotFound
+		}
+		return repo.insertOutbox(ctx, events)
+	})
+}
+
+func (repo *MongoUserRepository) List(ctx context.Context, query ListQuery) ([]*UserRecord, error) {
+	var users []*UserRecord
+
+	filter, opts := findQuery(query)
+	cursor, err := repo.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var user UserRecord
+		if err := cursor.Decode(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Export reads the users a page at a time after the last user of the previous
+// page, each page is a short query of its own so no cursor or snapshot has to
+// outlive a slow client. The next page is only read once fn took the previous
+// one.
+func (repo *MongoUserRepository) Export(ctx context.Context, query ListQuery, fn func(*UserRecord) error) error {
+	sort := query.sort()
+	query.Limit = exportBatchSize
+	if len(query.Fields) > 0 {
+		// the next page starts after the sort key of the last user
+		for _, field := range sort {
+			if !slices.Contains(query.Fields, field.Field) {
+				query.Fields = append(slices.Clone(query.Fields), field.Field)
+			}
+		}
+	}
+
+	for {
+		users, err := repo.List(ctx, query)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		if len(users) < exportBatchSize {
+			return nil
+		}
+		query.After = &Cursor{Values: sortKey(users[len(users)-1], sort)}
+	}
+}
+
+// findQuery is the find filter and options of a ListQuery
+func findQuery(query ListQuery) (bson.M, *options.FindOptions) {
+	opts := options.Find().
+		SetSort(mongoSort(query.sort())).
+		SetSkip(query.Skip).
+		SetLimit(query.Limit)
+	if len(query.Fields) > 0 {
+		opts.SetProjection(projection(query.Fields))
+	}
+
+	filter := mongoFilter(query.Filter)
+	if query.After != nil {
+		filter = bson.M{"$and": bson.A{filter, mongoAfter(query.sort(), query.After)}}
+	}
+	return filter, opts
+}
+
+func (repo *MongoUserRepository) Count(ctx context.Context, filter Filter) (int64, error) {
+	return repo.collection.CountDocuments(ctx, mongoFilter(filter))
+}
+
+func (repo *MongoUserRepository) EstimatedCount(ctx context.Context) (int64, error) {
+	return repo.collection.EstimatedDocumentCount(ctx)
+}
+
+func (repo *MongoUserRepository) Search(ctx context.Context, query SearchQuery) ([]*SearchHit, error) {
+	score := bson.M{"$meta": "textScore"}
+	fields := bson.D{{Key: "search_prefixes", Value: 0}}
+	if len(query.Fields) > 0 {
+		fields = projection(query.Fields)
+	}
+
+	opts := options.Find().
+		SetProjection(append(fields, bson.E{Key: "score", Value: score})).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "id", Value: 1}}).
+		SetSkip(query.Skip).
+		SetLimit(query.Limit)
+
+	filter := mongoFilter(query.Filter)
+	filter["$text"] = bson.M{"$search": strings.Join(query.Terms, " ")}
+
+	cursor, err := repo.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var hits []*SearchHit
+	for cursor.Next(ctx) {
+		var result searchDocument
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		hits = append(hits, &SearchHit{User: &result.UserRecord, Score: result.Score})
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return hits, nil
+}
+
+// searchDocument is a stored user with the fields only search uses
+type searchDocument struct {
+	UserRecord     `bson:",inline"`
+	SearchPrefixes []string `bson:"search_prefixes,omitempty"`
+	Score          float64  `bson:"score,omitempty"`
+}
+
+// PendingOutbox returns up to limit undelivered messages due at now, oldest
+// first, claimed or not
+func (repo *MongoUserRepository) PendingOutbox(ctx context.Context, now time.Time, limit int) ([]*OutboxMessage, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: 1}}).
+		SetLimit(int64(limit))
+
+	filter := bson.M{
+		"delivered_at":    bson.M{"$exists": false},
+		"next_attempt_at": bson.M{"$lte": now},
+	}
+
+	cursor, err := repo.outbox.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*OutboxMessage
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// ClaimOutbox leases the messages one at a time with FindOneAndUpdate, so two
+// relays never claim the same one. A relay claims its own leased messages
+// again, they were held back behind a failed one. A claimed message with an older undelivered
+// message of its key, failed or leased by another relay, is released again and
+// the key is skipped for the rest of the call.
+func (repo *MongoUserRepository) ClaimOutbox(ctx context.Context, owner string, now time.Time, leaseUntil time.Time, limit int) ([]*OutboxMessage, error) {
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "created_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var messages []*OutboxMessage
+	// $nin needs arrays, nil slices are encoded as null
+	claimed := []string{}
+	blocked := []string{}
+	for len(messages) < limit {
+		filter := bson.M{
+			"delivered_at":    bson.M{"$exists": false},
+			"next_attempt_at": bson.M{"$lte": now},
+			"key":             bson.M{"$nin": blocked},
+			"$or": bson.A{
+				bson.M{"lease_expires_at": bson.M{"$exists": false}},
+				bson.M{"lease_expires_at": bson.M{"$lte": now}},
+				bson.M{"lease_owner": owner},
+			},
+		}
+		update := bson.M{"$set": bson.M{"lease_owner": owner, "lease_expires_at": leaseUntil}}
+
+		message := &OutboxMessage{}
+		err := repo.outbox.FindOneAndUpdate(ctx, filter, update, opts).Decode(message)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			break
+		}
+		if err != nil {
+			return messages, err
+		}
+
+		if message.Key != "" {
+			older, err := repo.outbox.CountDocuments(ctx, bson.M{
+				"key":          message.Key,
+				"delivered_at": bson.M{"$exists": false},
+				"created_at":   bson.M{"$lt": message.CreatedAt},
+				"id":           bson.M{"$nin": claimed},
+			}, options.Count().SetLimit(1))
+			if err != nil {
+				return messages, err
+			}
+			if older > 0 {
+				blocked = append(blocked, message.Key)
+				if err := repo.releaseOutbox(ctx, message.Id, owner); err != nil {
+					return messages, err
+				}
+				continue
+			}
+		}
+
+		claimed = append(claimed, message.Id)
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+func (repo *MongoUserRepository) releaseOutbox(ctx context.Context, id string, owner string) error {
+	_, err := repo.outbox.UpdateOne(ctx, bson.M{"id": id, "lease_owner": owner}, bson.M{
+		"$unset": bson.M{"lease_owner": "", "lease_expires_at": ""},
+	})
+	return err
+}
+
+func (repo *MongoUserRepository) MarkDelivered(ctx context.Context, id string, deliveredAt time.Time) error {
+	_, err := repo.outbox.UpdateOne(ctx, bson.M{"id": id}, bson.M{
+		"$set": bson.M{"delivered_at": deliveredAt},
+	})
+	return err
+}
+
+func (repo *MongoUserRepository) MarkFailed(ctx context.Context, id string, nextAttemptAt time.Time, lastError string) error {
+	_, err := repo.outbox.UpdateOne(ctx, bson.M{"id": id}, bson.M{
+		"$set":   bson.M{"next_attempt_at": nextAttemptAt, "last_error": lastError},
+		"$inc":   bson.M{"attempts": 1},
+		"$unset": bson.M{"lease_owner": "", "lease_expires_at": ""},
+	})
+	return err
+}
+
+func (repo *MongoUserRepository) insertOutbox(ctx context.Context, events []*OutboxMessage) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	documents := make([]any, len(events))
+	for i, event := range events {
+		documents[i] = event
+	}
+	_, err := repo.outbox.InsertMany(ctx, documents)
+	return err
+}
+
+func (repo *MongoUserRepository) withTransaction(ctx context.Context, fn func(ctx mongo.SessionContext) error) error {
+	session, err := repo.collection.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (any, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// duplicateKeyError turns a unique index violation into a DuplicateError, this
+// catches the writes that raced past CheckUnique
+func duplicateKeyError(err error) error {
+	if err == nil || !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+
+	for _, field := range []string{"email", "nickname"} {
+		if strings.Contains(err.Error(), "index: "+field+"_1") {
+			return &DuplicateError{Field: field}
+		}
+	}
+	return err
+}
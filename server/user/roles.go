@@ -0,0 +1,163 @@
+package grpc_user
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/zecst19/grpc-user/proto"
+	"github.com/zecst19/grpc-user/server/auth"
+)
+
+const (
+	PermissionUsersRead   = "users.read"
+	PermissionUsersList   = "users.list"
+	PermissionUsersWrite  = "users.write"
+	PermissionUsersDelete = "users.delete"
+	PermissionRolesManage = "roles.manage"
+
+	SupportRole = "support"
+)
+
+// Role is a named set of permissions that can be assigned to users
+type Role struct {
+	Name        string
+	Permissions []string
+}
+
+// DefaultRoles is the role catalog used unless WithRoles replaces it
+func DefaultRoles() []Role {
+	return []Role{
+		{
+			Name: auth.AdminRole,
+			Permissions: []string{
+				PermissionUsersRead,
+				PermissionUsersList,
+				PermissionUsersWrite,
+				PermissionUsersDelete,
+				PermissionRolesManage,
+			},
+		},
+		{
+			Name:        SupportRole,
+			Permissions: []string{PermissionUsersRead, PermissionUsersList},
+		},
+	}
+}
+
+// WithRoles replaces the role catalog
+func WithRoles(roles []Role) Option {
+	return func(svc *UserService) {
+		svc.roles = roles
+	}
+}
+
+func (svc *UserService) role(name string) (Role, bool) {
+	for _, role := range svc.roles {
+		if role.Name == name {
+			return role, true
+		}
+	}
+	return Role{}, false
+}
+
+// permissions returns the permissions granted by the roles, in catalog order
+func (svc *UserService) permissions(roles []string) []string {
+	var permissions []string
+	for _, role := range svc.roles {
+		if !slices.Contains(roles, role.Name) {
+			continue
+		}
+		for _, permission := range role.Permissions {
+			if !slices.Contains(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions
+}
+
+// toProto returns the public view of the user with its permissions resolved
+func (svc *UserService) toProto(rec *UserRecord) *pb.User {
+	user := rec.toProto()
+	user.Permissions = svc.permissions(rec.Roles)
+	if svc.legacyTimestamps {
+		user.LegacyCreatedAt = legacyTime(rec.CreatedAt)
+		user.LegacyUpdatedAt = legacyTime(rec.UpdatedAt)
+	}
+	return user
+}
+
+func (svc *UserService) toProtoUsers(records []*UserRecord) []*pb.User {
+	users := make([]*pb.User, len(records))
+	for i, rec := range records {
+		users[i] = svc.toProto(rec)
+	}
+	return users
+}
+
+func (svc *UserService) AssignRole(ctx context.Context, req *pb.AssignRoleRequest) (*pb.User, error) {
+	return svc.changeRole(ctx, req.Id, req.Role, "assigned")
+}
+
+func (svc *UserService) RevokeRole(ctx context.Context, req *pb.RevokeRoleRequest) (*pb.User, error) {
+	return svc.changeRole(ctx, req.Id, req.Role, "revoked")
+}
+
+func (svc *UserService) ListRoles(ctx context.Context, req *pb.ListRolesRequest) (*pb.ListRolesResponse, error) {
+	roles := make([]*pb.Role, len(svc.roles))
+	for i, role := range svc.roles {
+		roles[i] = &pb.Role{Name: role.Name, Permissions: role.Permissions}
+	}
+
+	return &pb.ListRolesResponse{Roles: roles}, nil
+}
+
+func (svc *UserService) changeRole(ctx context.Context, id string, name string, action string) (*pb.User, error) {
+	if _, ok := svc.role(name); !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Unknown role %q", name)
+	}
+
+	user, err := svc.getActiveUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	hasRole := slices.Contains(user.Roles, name)
+	if (action == "assigned") == hasRole {
+		// nothing changes, so there is nothing to store or announce
+		return svc.toProto(user), nil
+	}
+
+	update := user.clone()
+	if action == "assigned" {
+		update.Roles = append(update.Roles, name)
+	} else {
+		update.Roles = slices.DeleteFunc(update.Roles, func(role string) bool { return role == name })
+	}
+	update.UpdatedAt = storeTime(time.Now())
+	update.Version++
+
+	events, err := svc.outboxEvents("user.role_changed", update.Id, roleChangedEvent{
+		Id:     update.Id,
+		Role:   name,
+		Action: action,
+		Roles:  update.Roles,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to serialize event: %v", err)
+	}
+
+	updatedUser, err := svc.repository.Update(ctx, update, []string{"roles"}, events...)
+	if err != nil {
+		return nil, writeError(err, "change roles")
+	}
+
+	log.Printf("Role %v %v:  %v", name, action, id)
+
+	return svc.toProto(updatedUser), nil
+}
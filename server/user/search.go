@@ -0,0 +1,234 @@
+package grpc_user
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+const (
+	// minTermLength is the shortest word worth looking up, shorter ones match
+	// too many users
+	minTermLength  = 2
+	maxSearchTerms = 10
+	maxQueryLength = 200
+)
+
+type searchField struct {
+	Field  string
+	Weight int
+}
+
+// searchFields are the fields SearchUsers looks in with their weight, a word
+// matching a whole word scores its field weight plus prefixWeight and a word
+// matching only the start of one scores prefixWeight
+var searchFields = []searchField{
+	{Field: "nickname", Weight: 4},
+	{Field: "first_name", Weight: 3},
+	{Field: "last_name", Weight: 3},
+	{Field: "email", Weight: 2},
+}
+
+const prefixWeight = 1
+
+// searchWord is a word of a text, start and end are in characters
+type searchWord struct {
+	Text  string
+	Start int
+	End   int
+}
+
+// searchWords splits text into lowercased words of letters and digits, so
+// "cristiano@ronaldo.com" has the words cristiano, ronaldo and com
+func searchWords(text string) []searchWord {
+	var words []searchWord
+	var word []rune
+	start := 0
+	for i, r := range []rune(text + " ") {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if len(word) == 0 {
+				start = i
+			}
+			word = append(word, unicode.ToLower(r))
+			continue
+		}
+		if len(word) > 0 {
+			words = append(words, searchWord{Text: string(word), Start: start, End: i})
+			word = word[:0]
+		}
+	}
+	return words
+}
+
+// searchTerms returns the distinct words of a query that are long enough to
+// look up
+func searchTerms(query string) []string {
+	var terms []string
+	for _, word := range searchWords(query) {
+		if len([]rune(word.Text)) >= minTermLength && !slices.Contains(terms, word.Text) {
+			terms = append(terms, word.Text)
+		}
+	}
+	return terms
+}
+
+// searchPrefixes returns the starts of the words of the searched fields, the
+// MongoDB text index matches whole words so these make it match partial ones
+func searchPrefixes(user *UserRecord) []string {
+	var prefixes []string
+	for _, field := range searchFields {
+		for _, word := range searchWords(fieldValue(user, field.Field)) {
+			runes := []rune(word.Text)
+			for length := minTermLength; length <= len(runes); length++ {
+				if prefix := string(runes[:length]); !slices.Contains(prefixes, prefix) {
+					prefixes = append(prefixes, prefix)
+				}
+			}
+		}
+	}
+	return prefixes
+}
+
+// isSearched reports whether any of the bson fields is searched
+func isSearched(fields []string) bool {
+	return slices.ContainsFunc(searchFields, func(f searchField) bool {
+		return slices.Contains(fields, f.Field)
+	})
+}
+
+// searchScore scores how well the user matches the terms, 0 means it doesn't
+func searchScore(user *UserRecord, terms []string) float64 {
+	var score int
+	for _, term := range terms {
+		for _, field := range searchFields {
+			words := searchWords(fieldValue(user, field.Field))
+			switch {
+			case slices.ContainsFunc(words, func(w searchWord) bool { return w.Text == term }):
+				score += field.Weight + prefixWeight
+			case slices.ContainsFunc(words, func(w searchWord) bool { return strings.HasPrefix(w.Text, term) }):
+				score += prefixWeight
+			}
+		}
+	}
+	return float64(score)
+}
+
+// SearchIndex is the in-process search of InMemoryUserRepository, the repository
+// keeps it up to date on every write
+type SearchIndex interface {
+	// Put adds the user or replaces its previous version
+	Put(user *UserRecord)
+	Remove(id string)
+	// Search returns the score of every user matching any of the terms by id
+	Search(terms []string) map[string]float64
+}
+
+// PrefixIndex is the default SearchIndex, it maps every word start of the
+// searched fields to the users that have it
+type PrefixIndex struct {
+	mu       sync.RWMutex
+	users    map[string]*UserRecord
+	postings map[string]map[string]struct{}
+}
+
+func NewPrefixIndex() *PrefixIndex {
+	return &PrefixIndex{
+		users:    make(map[string]*UserRecord),
+		postings: make(map[string]map[string]struct{}),
+	}
+}
+
+func (index *PrefixIndex) Put(user *UserRecord) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.remove(user.Id)
+	indexed := &UserRecord{
+		Id:        user.Id,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Nickname:  user.Nickname,
+		Email:     user.Email,
+	}
+	index.users[user.Id] = indexed
+
+	for _, prefix := range searchPrefixes(indexed) {
+		if index.postings[prefix] == nil {
+			index.postings[prefix] = make(map[string]struct{})
+		}
+		index.postings[prefix][user.Id] = struct{}{}
+	}
+}
+
+func (index *PrefixIndex) Remove(id string) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.remove(id)
+}
+
+// remove must be called with index.mu held
+func (index *PrefixIndex) remove(id string) {
+	user, ok := index.users[id]
+	if !ok {
+		return
+	}
+	for _, prefix := range searchPrefixes(user) {
+		delete(index.postings[prefix], id)
+		if len(index.postings[prefix]) == 0 {
+			delete(index.postings, prefix)
+		}
+	}
+	delete(index.users, id)
+}
+
+func (index *PrefixIndex) Search(terms []string) map[string]float64 {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	scores := make(map[string]float64)
+	for _, term := range terms {
+		for id := range index.postings[term] {
+			if _, ok := scores[id]; !ok {
+				scores[id] = searchScore(index.users[id], terms)
+			}
+		}
+	}
+	return scores
+}
+
+// highlights marks the words of the user fields that start with a term, it
+// works on the returned User so fields left out by the read mask are never
+// highlighted
+func highlights(user *pb.User, terms []string) []*pb.Highlight {
+	values := map[string]string{
+		"nickname":   user.Nickname,
+		"first_name": user.FirstName,
+		"last_name":  user.LastName,
+		"email":      user.Email,
+	}
+
+	var found []*pb.Highlight
+	for _, field := range searchFields {
+		var ranges []*pb.TextRange
+		for _, word := range searchWords(values[field.Field]) {
+			// the longest term is the most precise match
+			length := 0
+			for _, term := range terms {
+				if strings.HasPrefix(word.Text, term) {
+					length = max(length, len([]rune(term)))
+				}
+			}
+			if length > 0 {
+				ranges = append(ranges, &pb.TextRange{Start: int32(word.Start), End: int32(word.Start + length)})
+			}
+		}
+		if len(ranges) > 0 {
+			found = append(found, &pb.Highlight{Field: field.Field, Ranges: ranges})
+		}
+	}
+	return found
+}
@@ -0,0 +1,118 @@
+package grpc_user
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	for _, user := range []*UserRecord{
+		{Id: "a", FirstName: "Cristiano", LastName: "Ronaldo", Nickname: "CR7", Email: "cristiano@ronaldo.com", PasswordHash: "secret"},
+		{Id: "b", FirstName: "Ronaldo", LastName: "Nazario", Nickname: "R9", Email: "r9@fenomeno.com.br"},
+		{Id: "c", FirstName: "Ronaldinho", LastName: "Gaucho", Nickname: "R10", Email: "ronaldinho@gaucho.com.br"},
+		{Id: "d", FirstName: "Mohammed", LastName: "Salah", Nickname: "MoSalah", Email: "mo@salah.com"},
+	} {
+		require.NoError(t, user_repository.Create(ctx, user))
+	}
+	svc := NewUserService(user_repository, nil)
+
+	search := func(t *testing.T, req *pb.SearchUsersRequest) *pb.SearchUsersResponse {
+		resp, err := svc.SearchUsers(ctx, req)
+		require.NoError(t, err)
+		return resp
+	}
+	ids := func(resp *pb.SearchUsersResponse) []string {
+		var ids []string
+		for _, result := range resp.Results {
+			ids = append(ids, result.User.Id)
+		}
+		return ids
+	}
+
+	t.Run("Terms", func(t *testing.T) {
+		require.Equal(t, []string{"cristiano", "ronaldo", "com"}, searchTerms("Cristiano@Ronaldo.com, a"))
+		require.Equal(t, []string{"cr", "cr7"}, searchPrefixes(&UserRecord{Nickname: "CR7", FirstName: "C"}))
+	})
+
+	t.Run("Ranked", func(t *testing.T) {
+		resp := search(t, &pb.SearchUsersRequest{Query: "ronaldo"})
+		require.Equal(t, []string{"a", "b"}, ids(resp))
+		require.Greater(t, resp.Results[0].Score, resp.Results[1].Score)
+
+		// whole words beat the start of a longer one
+		resp = search(t, &pb.SearchUsersRequest{Query: "gau R9"})
+		require.Equal(t, []string{"b", "c"}, ids(resp))
+	})
+
+	t.Run("Partial Words", func(t *testing.T) {
+		require.Equal(t, []string{"d"}, ids(search(t, &pb.SearchUsersRequest{Query: "sal"})))
+		require.Equal(t, []string{"a", "c", "b"}, ids(search(t, &pb.SearchUsersRequest{Query: "ronald"})))
+		require.Empty(t, ids(search(t, &pb.SearchUsersRequest{Query: "messi"})))
+	})
+
+	t.Run("Highlights", func(t *testing.T) {
+		resp := search(t, &pb.SearchUsersRequest{Query: "cris ronal"})
+		require.Equal(t, "a", resp.Results[0].User.Id)
+		require.Empty(t, resp.Results[0].User.Permissions)
+
+		var fields []string
+		for _, highlight := range resp.Results[0].Highlights {
+			fields = append(fields, highlight.Field)
+		}
+		require.Equal(t, []string{"first_name", "last_name", "email"}, fields)
+		require.Equal(t, []*pb.TextRange{{Start: 0, End: 4}, {Start: 10, End: 15}}, resp.Results[0].Highlights[2].Ranges)
+	})
+
+	t.Run("Read Mask Hides Highlights", func(t *testing.T) {
+		resp := search(t, &pb.SearchUsersRequest{Query: "mo salah", ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"id", "nickname"}}})
+		require.Len(t, resp.Results, 1)
+		require.Empty(t, resp.Results[0].User.Email)
+		require.Empty(t, resp.Results[0].User.LastName)
+		require.Len(t, resp.Results[0].Highlights, 1)
+		require.Equal(t, "nickname", resp.Results[0].Highlights[0].Field)
+	})
+
+	t.Run("Page Tokens", func(t *testing.T) {
+		var seen []string
+		req := &pb.SearchUsersRequest{Query: "ronald", PageSize: 2}
+		for {
+			resp := search(t, req)
+			seen = append(seen, ids(resp)...)
+			if resp.NextPageToken == "" {
+				break
+			}
+			req.PageToken = resp.NextPageToken
+		}
+		require.Equal(t, []string{"a", "c", "b"}, seen)
+
+		first := search(t, &pb.SearchUsersRequest{Query: "ronaldo", PageSize: 1})
+		_, err := svc.SearchUsers(ctx, &pb.SearchUsersRequest{Query: "salah", PageToken: first.NextPageToken})
+		require.Equal(t, []string{"page_token"}, fieldViolations(t, err))
+	})
+
+	t.Run("Index Follows Writes", func(t *testing.T) {
+		newNickname := "Pharaoh"
+		_, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{Id: "d", Nickname: &newNickname})
+		require.NoError(t, err)
+		require.Equal(t, []string{"d"}, ids(search(t, &pb.SearchUsersRequest{Query: "phara"})))
+		require.Empty(t, ids(search(t, &pb.SearchUsersRequest{Query: "mosal"})))
+
+		_, err = svc.DeleteUser(ctx, &pb.DeleteUserRequest{Id: "d"})
+		require.NoError(t, err)
+		require.Empty(t, ids(search(t, &pb.SearchUsersRequest{Query: "phara"})))
+	})
+
+	t.Run("Invalid Queries", func(t *testing.T) {
+		for _, query := range []string{"", "  ", "a b", "a b c d e f g h i j k l m n o p q r s t u v w x y z aa bb cc dd ee ff gg hh ii jj kk"} {
+			_, err := svc.SearchUsers(ctx, &pb.SearchUsersRequest{Query: query})
+			require.Equal(t, []string{"query"}, fieldViolations(t, err), query)
+		}
+	})
+}
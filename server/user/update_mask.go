@@ -0,0 +1,74 @@
+package grpc_user
+
+import (
+	"slices"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+// mutableFields are the fields UpdateUser can change. They are named the same
+// in UpdateUserRequest, User and the stored UserRecord, so a mask path is also
+// the field to $set.
+var mutableFields = []string{"first_name", "last_name", "nickname", "email", "country"}
+
+// immutableFields can't be changed with UpdateUser at all
+var immutableFields = []string{"id", "created_at", "updated_at", "version", "roles", "permissions", "password", "deleted_at", "legacy_created_at", "legacy_updated_at"}
+
+// updatePaths returns the fields an update changes, in mutableFields order.
+// Without a mask those are the fields set in the request.
+func updatePaths(req *pb.UpdateUserRequest) []string {
+	mask := req.GetUpdateMask().GetPaths()
+
+	var paths []string
+	for _, field := range mutableFields {
+		if len(mask) > 0 && slices.Contains(mask, field) || len(mask) == 0 && req.ProtoReflect().Has(requestDescriptor(field)) {
+			paths = append(paths, field)
+		}
+	}
+	return paths
+}
+
+func validateUpdateMask(v *violations, field string, paths []string) {
+	for _, path := range paths {
+		switch {
+		case path == "password":
+			v.add(field, "password can't be changed with UpdateUser, use ChangePassword")
+		case slices.Contains(immutableFields, path):
+			v.add(field, "%s can't be changed", path)
+		case !slices.Contains(mutableFields, path):
+			v.add(field, "unknown field %q", path)
+		}
+	}
+}
+
+// applyUpdate copies the fields listed in paths from the request onto the user,
+// unset fields copy as empty which is how a mask clears them
+func applyUpdate(user *pb.User, req *pb.UpdateUserRequest, paths []string) {
+	target := user.ProtoReflect()
+	for _, path := range paths {
+		field := target.Descriptor().Fields().ByName(protoreflect.Name(path))
+		target.Set(field, protoreflect.ValueOfString(requestField(req, path)))
+	}
+}
+
+// changedFields returns the paths whose value differs between the users
+func changedFields(before *pb.User, after *pb.User, paths []string) []string {
+	var changed []string
+	for _, path := range paths {
+		field := before.ProtoReflect().Descriptor().Fields().ByName(protoreflect.Name(path))
+		if !before.ProtoReflect().Get(field).Equal(after.ProtoReflect().Get(field)) {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+func requestDescriptor(path string) protoreflect.FieldDescriptor {
+	return (&pb.UpdateUserRequest{}).ProtoReflect().Descriptor().Fields().ByName(protoreflect.Name(path))
+}
+
+func requestField(req *pb.UpdateUserRequest, path string) string {
+	return req.ProtoReflect().Get(requestDescriptor(path)).String()
+}
@@ -0,0 +1,118 @@
+package grpc_user
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// fieldsRepository records the fields each update writes
+type fieldsRepository struct {
+	*InMemoryUserRepository
+	fields [][]string
+}
+
+func (repo *fieldsRepository) Update(ctx context.Context, user *UserRecord, fields []string, events ...*OutboxMessage) (*UserRecord, error) {
+	repo.fields = append(repo.fields, fields)
+	return repo.InMemoryUserRepository.Update(ctx, user, fields, events...)
+}
+
+func TestUpdateMask(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := &fieldsRepository{InMemoryUserRepository: NewInMemoryUserRepository()}
+	svc := NewUserService(user_repository, nil, WithBcryptCost(bcrypt.MinCost))
+
+	user, err := svc.CreateUser(ctx, &pb.CreateUserRequest{
+		FirstName: "Mohammed",
+		LastName:  "Salah",
+		Nickname:  "MoSalah",
+		Password:  "word5678",
+		Email:     "mo@salah.com",
+		Country:   "EG",
+	})
+	require.NoError(t, err)
+
+	t.Run("Clear Nickname", func(t *testing.T) {
+		firstName := "Mo"
+		resp, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{
+			Id:         user.Id,
+			FirstName:  &firstName,
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"nickname"}},
+		})
+		require.NoError(t, err)
+		require.Empty(t, resp.Nickname)
+		// first_name isn't in the mask, so it is ignored
+		require.Equal(t, "Mohammed", resp.FirstName)
+		require.Equal(t, []string{"nickname"}, user_repository.fields[len(user_repository.fields)-1])
+	})
+
+	t.Run("Only Changed Fields Are Written", func(t *testing.T) {
+		country := "EG"
+		lastName := "Hamed Salah"
+		resp, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{
+			Id:         user.Id,
+			LastName:   &lastName,
+			Country:    &country,
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"last_name", "country"}},
+		})
+		require.NoError(t, err)
+		require.Equal(t, "Hamed Salah", resp.LastName)
+		require.Equal(t, []string{"last_name"}, user_repository.fields[len(user_repository.fields)-1])
+	})
+
+	t.Run("No Changes", func(t *testing.T) {
+		writes := len(user_repository.fields)
+		before, err := svc.GetUser(ctx, &pb.GetUserRequest{Id: user.Id})
+		require.NoError(t, err)
+
+		country := "EG"
+		resp, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, Country: &country})
+		require.NoError(t, err)
+		require.Equal(t, before.Version, resp.Version)
+		require.Len(t, user_repository.fields, writes)
+	})
+
+	t.Run("Rejected Paths", func(t *testing.T) {
+		for _, path := range []string{"id", "created_at", "version", "roles", "password", "shoe_size"} {
+			_, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{
+				Id:         user.Id,
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{path}},
+			})
+			require.Equal(t, []string{"update_mask"}, fieldViolations(t, err), path)
+		}
+	})
+
+	t.Run("Masked Fields Are Validated", func(t *testing.T) {
+		_, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{
+			Id:         user.Id,
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"first_name", "email"}},
+		})
+		require.Equal(t, []string{"first_name", "email"}, fieldViolations(t, err))
+	})
+
+	t.Run("Users Without Nickname", func(t *testing.T) {
+		other, err := svc.CreateUser(ctx, &pb.CreateUserRequest{
+			FirstName: "Sadio",
+			LastName:  "Mane",
+			Nickname:  "Sadio10",
+			Password:  "word5678",
+			Email:     "sadio@mane.com",
+			Country:   "SN",
+		})
+		require.NoError(t, err)
+
+		_, err = svc.UpdateUser(ctx, &pb.UpdateUserRequest{
+			Id:         other.Id,
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"nickname"}},
+		})
+		require.NoError(t, err)
+
+		_, err = user_repository.FindByLogin(ctx, "")
+		require.ErrorIs(t, err, ErrUserNotFound)
+	})
+}
@@ -2,306 +2,512 @@ package grpc_user
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"log"
+	"runtime"
+	"slices"
+	"sync"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	"github.com/IBM/sarama"
 	"github.com/google/uuid"
 	pb "github.com/zecst19/grpc-user/proto"
+	"github.com/zecst19/grpc-user/server/auth"
 )
 
-var (
-	topic = "user-topic"
-)
+// UserService implements the UserService gRPC API. Events for writes are stored
+// in the repository outbox and delivered by an OutboxRelay, events for reads are
+// sent straight to the publisher.
+type UserService struct {
+	pb.UnimplementedUserServiceServer
+	repository     UserRepository
+	publisher      EventPublisher
+	eventPolicies  map[string]EventPolicy
+	passwordPolicy PasswordPolicy
+	bcryptCost     int
+	hashWorkers    int
+	tokenIssuer    *auth.TokenIssuer
+	roles          []Role
+	// legacyTimestamps fills the deprecated string times of User
+	legacyTimestamps bool
+
+	dummyHashOnce sync.Once
+	dummyHash     string
+}
 
-type Message struct {
-	Event string `json:"event"`
-	Value any    `json:"value"`
+type Option func(*UserService)
+
+// WithEventPolicy overrides the delivery policy of one event type
+func WithEventPolicy(event string, policy EventPolicy) Option {
+	return func(svc *UserService) {
+		svc.eventPolicies[event] = policy
+	}
 }
 
-type UserService struct {
-	pb.UnimplementedUserServiceServer
-	collection    *mongo.Collection
-	kafkaProducer sarama.SyncProducer
+// WithPasswordPolicy sets the rules new passwords must follow
+func WithPasswordPolicy(policy PasswordPolicy) Option {
+	return func(svc *UserService) {
+		svc.passwordPolicy = policy
+	}
+}
+
+// WithBcryptCost sets the bcrypt cost used to hash passwords
+func WithBcryptCost(cost int) Option {
+	return func(svc *UserService) {
+		svc.bcryptCost = cost
+	}
 }
 
-func NewUserService(collection *mongo.Collection, kafkaProducer sarama.SyncProducer) *UserService {
-	return &UserService{collection: collection, kafkaProducer: kafkaProducer}
+// WithLegacyTimestamps sets whether users keep the deprecated legacy_created_at
+// and legacy_updated_at strings for clients that predate the Timestamp fields,
+// they are filled by default
+func WithLegacyTimestamps(enabled bool) Option {
+	return func(svc *UserService) {
+		svc.legacyTimestamps = enabled
+	}
+}
+
+func NewUserService(repository UserRepository, publisher EventPublisher, opts ...Option) *UserService {
+	if publisher == nil {
+		publisher = NoopPublisher{}
+	}
+
+	svc := &UserService{
+		repository:     repository,
+		publisher:      publisher,
+		eventPolicies:  DefaultEventPolicies(),
+		passwordPolicy: DefaultPasswordPolicy(),
+		bcryptCost:     DefaultBcryptCost,
+		hashWorkers:    runtime.GOMAXPROCS(0),
+		roles:          DefaultRoles(),
+
+		legacyTimestamps: true,
+	}
+	for _, opt := range opts {
+		opt(svc)
+	}
+
+	return svc
 }
 
 func (svc *UserService) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.User, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), 14)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to hash password: %v", err)
+	email := normalizeEmail(req.Email)
+	if err := svc.validateCreateUser(req); err != nil {
+		return nil, err
 	}
 
-	user := &pb.User{
-		Id:        uuid.New().String(),
-		FirstName: req.FirstName,
-		LastName:  req.LastName,
-		Nickname:  req.Nickname,
-		Password:  string(hashedPassword),
-		Email:     req.Email,
-		Country:   req.Country,
-		CreatedAt: time.Now().Format(time.RFC3339),
-		UpdatedAt: time.Now().Format(time.RFC3339),
+	// the unique indexes still catch writes that race past this check
+	if err := svc.repository.CheckUnique(ctx, "", email, req.Nickname); err != nil {
+		return nil, writeError(err, "check user")
 	}
 
-	_, err = svc.collection.InsertOne(ctx, user)
+	hashedPassword, err := svc.hashPassword(req.Password)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to create user: %v", err)
+		return nil, status.Errorf(codes.Internal, "Failed to hash password: %v", err)
 	}
 
-	// Build kafka message
-	message := Message{
-		Event: "user.created",
-		Value: user,
+	user := &UserRecord{
+		Id:           uuid.New().String(),
+		FirstName:    req.FirstName,
+		LastName:     req.LastName,
+		Nickname:     req.Nickname,
+		PasswordHash: hashedPassword,
+		Email:        email,
+		Country:      req.Country,
+		CreatedAt:    storeTime(time.Now()),
+		UpdatedAt:    storeTime(time.Now()),
+		Version:      1,
 	}
 
-	log.Printf("User Created:  %v", user.Id)
-
-	serializedMessage, err := json.Marshal(message)
+	events, err := svc.outboxEvents("user.created", user.Id, newUserEvent(svc.toProto(user)))
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to serialize Producer message: %v", err)
+		return nil, status.Errorf(codes.Internal, "Failed to serialize event: %v", err)
 	}
 
-	err = svc.produceMessage(serializedMessage)
+	err = svc.repository.Create(ctx, user, events...)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to send Producer message: %v", err)
+		return nil, writeError(err, "create user")
 	}
 
-	return user, nil
+	log.Printf("User Created:  %v", user.Id)
+
+	return svc.toProto(user), nil
 }
 
 func (svc *UserService) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.User, error) {
-	var user pb.User
-	err := svc.collection.FindOne(ctx, bson.M{"id": req.Id}).Decode(&user)
+	var v violations
+	validateReadMask(&v, "read_mask", req.ReadMask)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	fields := readFields(req.ReadMask)
+	if len(fields) > 0 && !slices.Contains(fields, "deleted_at") {
+		fields = append(fields, "deleted_at")
+	}
+
+	user, err := svc.repository.Get(ctx, req.Id, fields...)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if errors.Is(err, ErrUserNotFound) {
 			return nil, status.Errorf(codes.NotFound, "User not found")
 		}
 		return nil, status.Errorf(codes.Internal, "Failed to get user: %v", err)
 	}
-
-	log.Printf("User Fetched:  %v", user.Id)
-
-	// Build kafka message
-	message := Message{
-		Event: "user.get",
-		Value: &user,
+	if user.deleted() && !req.ShowDeleted {
+		return nil, status.Errorf(codes.NotFound, "User not found")
 	}
 
-	serializedMessage, err := json.Marshal(message)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to serialize Producer message: %v", err)
-	}
+	log.Printf("User Fetched:  %v", req.Id)
 
-	err = svc.produceMessage(serializedMessage)
+	response := pruneUser(svc.toProto(user), req.ReadMask)
+	err = svc.publish(ctx, "user.get", newUserEvent(response))
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to send Producer message: %v", err)
 	}
 
-	return &user, nil
+	return response, nil
 }
 
 func (svc *UserService) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.User, error) {
-	//call the get and fill these variables with it
-	var user pb.User
-	err := svc.collection.FindOne(ctx, bson.M{"id": req.Id}).Decode(&user)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, status.Errorf(codes.NotFound, "User not found")
-		}
-		return nil, status.Errorf(codes.Internal, "Failed to get user: %v", err)
+	paths := updatePaths(req)
+	if err := svc.validateUpdateUser(req, paths); err != nil {
+		return nil, err
 	}
 
-	updatedFirstName := user.FirstName
-	if req.FirstName != nil {
-		updatedFirstName = *req.FirstName
+	user, err := svc.getActiveUser(ctx, req.Id)
+	if err != nil {
+		return nil, err
 	}
 
-	updatedLastName := user.LastName
-	if req.LastName != nil {
-		updatedLastName = *req.LastName
+	if req.ExpectedVersion != nil && *req.ExpectedVersion != user.Version {
+		return nil, status.Errorf(codes.FailedPrecondition, "User is at version %d, expected %d", user.Version, *req.ExpectedVersion)
 	}
 
-	updatedNickname := user.Nickname
-	if req.Nickname != nil {
-		updatedNickname = *req.Nickname
-	}
+	profile := user.toProto()
+	applyUpdate(profile, req, paths)
+	profile.Email = normalizeEmail(profile.Email)
 
-	updatedEmail := user.Email
-	if req.Email != nil {
-		updatedEmail = *req.Email
-	}
+	update := user.clone()
+	update.FirstName = profile.FirstName
+	update.LastName = profile.LastName
+	update.Nickname = profile.Nickname
+	update.Email = profile.Email
+	update.Country = profile.Country
 
-	updatedCountry := user.Country
-	if req.Country != nil {
-		updatedCountry = *req.Country
+	fields := changedFields(user.toProto(), profile, paths)
+	if len(fields) == 0 {
+		// nothing changes, so there is nothing to store or announce
+		return svc.toProto(user), nil
 	}
 
-	update := bson.M{
-		"$set": &pb.User{
-			Id:        user.Id,
-			FirstName: updatedFirstName,
-			LastName:  updatedLastName,
-			Nickname:  updatedNickname,
-			Password:  user.Password,
-			Email:     updatedEmail,
-			Country:   updatedCountry,
-			CreatedAt: user.CreatedAt,
-			UpdatedAt: time.Now().Format(time.RFC3339),
-		},
+	update.UpdatedAt = storeTime(time.Now())
+	update.Version = user.Version + 1
+
+	if update.Email != user.Email || update.Nickname != user.Nickname {
+		if err := svc.repository.CheckUnique(ctx, update.Id, update.Email, update.Nickname); err != nil {
+			return nil, writeError(err, "check user")
+		}
 	}
 
-	var updatedUser pb.User
-	err = svc.collection.FindOneAndUpdate(
-		ctx,
-		bson.M{"id": req.Id},
-		update,
-		options.FindOneAndUpdate().SetReturnDocument(options.After),
-	).Decode(&updatedUser)
+	events, err := svc.outboxEvents("user.update", update.Id, newUserEvent(svc.toProto(update)))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to serialize event: %v", err)
+	}
 
+	updatedUser, err := svc.repository.Update(ctx, update, fields, events...)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, status.Errorf(codes.NotFound, "User not found")
-		}
-		return nil, status.Errorf(codes.Internal, "Failed to update user: %v", err)
+		return nil, writeError(err, "update user")
 	}
 
 	log.Printf("User Updated:  %v", user.Id)
 
-	// Build kafka message
-	message := Message{
-		Event: "user.update",
-		Value: &updatedUser,
+	return svc.toProto(updatedUser), nil
+}
+
+// DeleteUser only marks the user deleted, RestoreUser undoes it until the
+// UserPurger removes it
+func (svc *UserService) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+	user, err := svc.getActiveUser(ctx, req.Id)
+	if err != nil {
+		return nil, err
 	}
 
-	serializedMessage, err := json.Marshal(message)
+	update := user.clone()
+	deletedAt := storeTime(time.Now())
+	update.DeletedAt = &deletedAt
+	update.UpdatedAt = deletedAt
+	update.Version++
+
+	events, err := svc.outboxEvents("user.deleted", update.Id, newUserEvent(svc.toProto(update)))
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to serialize Producer message: %v", err)
+		return nil, status.Errorf(codes.Internal, "Failed to serialize event: %v", err)
 	}
 
-	err = svc.produceMessage(serializedMessage)
+	_, err = svc.repository.Update(ctx, update, []string{"deleted_at"}, events...)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to send Producer message: %v", err)
+		return nil, writeError(err, "delete user")
 	}
+	if err := svc.revokeRefreshTokens(ctx, update.Id); err != nil {
+		return nil, err
+	}
+
+	log.Printf("User Deleted:  %v", req.Id)
 
-	return &updatedUser, nil
+	return &pb.DeleteUserResponse{Success: true}, nil
 }
 
-func (svc *UserService) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
-	res, err := svc.collection.DeleteOne(ctx, bson.M{"id": req.Id})
+func (svc *UserService) RestoreUser(ctx context.Context, req *pb.RestoreUserRequest) (*pb.User, error) {
+	user, err := svc.repository.Get(ctx, req.Id)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to delete user: %v", err)
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, status.Errorf(codes.NotFound, "User not found")
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to get user: %v", err)
 	}
-
-	if res.DeletedCount == 0 {
-		return nil, status.Errorf(codes.NotFound, "User not found")
+	if !user.deleted() {
+		return nil, status.Errorf(codes.FailedPrecondition, "User is not deleted")
 	}
 
-	log.Printf("User Deleted:  %v", req.Id)
+	update := user.clone()
+	update.DeletedAt = nil
+	update.UpdatedAt = storeTime(time.Now())
+	update.Version++
 
-	// Build kafka message
-	message := Message{
-		Event: "user.delete",
-		Value: req.Id,
+	events, err := svc.outboxEvents("user.restored", update.Id, newUserEvent(svc.toProto(update)))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to serialize event: %v", err)
 	}
 
-	serializedMessage, err := json.Marshal(message)
+	restoredUser, err := svc.repository.Update(ctx, update, []string{"deleted_at"}, events...)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to serialize Producer message: %v", err)
+		return nil, writeError(err, "restore user")
 	}
 
-	err = svc.produceMessage(serializedMessage)
+	log.Printf("User Restored:  %v", req.Id)
+
+	return svc.toProto(restoredUser), nil
+}
+
+// getActiveUser loads a user for a change, deleted users can't be changed so
+// they are reported as not found
+func (svc *UserService) getActiveUser(ctx context.Context, id string) (*UserRecord, error) {
+	user, err := svc.repository.Get(ctx, id)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to send Producer message: %v", err)
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, status.Errorf(codes.NotFound, "User not found")
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to get user: %v", err)
 	}
-
-	return &pb.DeleteUserResponse{Success: true}, nil
+	if user.deleted() {
+		return nil, status.Errorf(codes.NotFound, "User not found")
+	}
+	return user, nil
 }
 
 func (svc *UserService) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
-	var users []*pb.User
-
-	opts := options.Find().
-		SetSkip(int64((req.Page - 1) * req.PageSize)).
-		SetLimit(int64(req.PageSize))
+	var v violations
+	validateReadMask(&v, "read_mask", req.ReadMask)
+	pageSize := validatePaging(&v, req)
+	filter := listUsersFilter(&v, req)
+	sort := parseOrderBy(&v, "order_by", req.OrderBy)
+
+	filterKey := listFilter(req)
+	var after *Cursor
+	if req.PageToken != "" {
+		cursor, err := decodePageToken(req.PageToken, filterKey, sort)
+		if err != nil {
+			v.add("page_token", "%v", err)
+		}
+		after = cursor
+	}
 
-	filter := bson.M{}
-	if req.Country != nil {
-		filter["country"] = req.Country
+	if err := v.err(); err != nil {
+		return nil, err
 	}
 
-	if req.LastName != nil {
-		filter["last_name"] = req.LastName
+	query := ListQuery{
+		Filter: visibleUsers(filter, req.ShowDeleted),
+		Sort:   sort,
+		Limit:  int64(pageSize) + 1,
+		After:  after,
+		Fields: readFields(req.ReadMask),
+	}
+	if req.Page > 1 {
+		query.Skip = int64(req.Page-1) * int64(pageSize)
+	}
+	if len(query.Fields) > 0 {
+		// the next page token is built from the sort fields
+		for _, key := range sort {
+			if !slices.Contains(query.Fields, key.Field) {
+				query.Fields = append(query.Fields, key.Field)
+			}
+		}
 	}
 
-	cursor, err := svc.collection.Find(ctx, filter, opts)
+	// one extra user tells whether there is a next page
+	records, err := svc.repository.List(ctx, query)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to list users: %v", err)
 	}
-	defer cursor.Close(ctx)
 
-	for cursor.Next(ctx) {
-		var user pb.User
-		if err := cursor.Decode(&user); err != nil {
-			return nil, status.Errorf(codes.Internal, "Failed to decode user: %v", err)
-		}
-		users = append(users, &user)
+	var nextPageToken string
+	if len(records) > pageSize {
+		records = records[:pageSize]
+		nextPageToken = encodePageToken(records[pageSize-1], sort, filterKey)
 	}
 
-	if err := cursor.Err(); err != nil {
-		return nil, status.Errorf(codes.Internal, "Cursor error: %v", err)
+	totalCount, countMode, err := svc.countUsers(ctx, req.CountMode, filter, req.ShowDeleted)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to count users: %v", err)
 	}
 
-	totalCount, err := svc.collection.CountDocuments(ctx, bson.M{})
+	log.Printf("Users Listed:  %v", len(records))
+
+	users := svc.toProtoUsers(records)
+	for _, user := range users {
+		pruneUser(user, req.ReadMask)
+	}
+	err = svc.publish(ctx, "user.list", newUserEvents(users))
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to count users: %v", err)
+		return nil, status.Errorf(codes.Internal, "Failed to send Producer message: %v", err)
 	}
 
-	log.Printf("Users Listed:  %v", len(users))
+	return &pb.ListUsersResponse{
+		Users:         users,
+		TotalCount:    int32(totalCount),
+		NextPageToken: nextPageToken,
+		CountMode:     countMode,
+	}, nil
+}
+
+func (svc *UserService) SearchUsers(ctx context.Context, req *pb.SearchUsersRequest) (*pb.SearchUsersResponse, error) {
+	var v violations
+	validateReadMask(&v, "read_mask", req.ReadMask)
+	terms := validateSearch(&v, req)
+	pageSize := validatePageSize(&v, req.PageSize)
+
+	var offset int64
+	if req.PageToken != "" && len(terms) > 0 {
+		decoded, err := decodeSearchPageToken(req.PageToken, terms, req.ShowDeleted)
+		if err != nil {
+			v.add("page_token", "%v", err)
+		}
+		offset = decoded
+	}
 
-	// Build kafka message
-	message := Message{
-		Event: "user.list",
-		Value: users,
+	if err := v.err(); err != nil {
+		return nil, err
 	}
 
-	serializedMessage, err := json.Marshal(message)
+	// one extra hit tells whether there is a next page
+	hits, err := svc.repository.Search(ctx, SearchQuery{
+		Terms:  terms,
+		Filter: visibleUsers(nil, req.ShowDeleted),
+		Skip:   offset,
+		Limit:  int64(pageSize) + 1,
+		Fields: readFields(req.ReadMask),
+	})
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to serialize Producer message: %v", err)
+		return nil, status.Errorf(codes.Internal, "Failed to search users: %v", err)
+	}
+
+	var nextPageToken string
+	if len(hits) > pageSize {
+		hits = hits[:pageSize]
+		nextPageToken = encodeSearchPageToken(offset+int64(pageSize), terms, req.ShowDeleted)
 	}
 
-	err = svc.produceMessage(serializedMessage)
+	log.Printf("Users Searched:  %v", len(hits))
+
+	// highlights are taken from the pruned user, so hidden fields stay hidden
+	results := make([]*pb.SearchResult, len(hits))
+	events := make([]searchResultEvent, len(hits))
+	for i, hit := range hits {
+		user := pruneUser(svc.toProto(hit.User), req.ReadMask)
+		results[i] = &pb.SearchResult{
+			User:       user,
+			Score:      hit.Score,
+			Highlights: highlights(user, terms),
+		}
+		events[i] = searchResultEvent{User: newUserEvent(user), Score: hit.Score, Highlights: results[i].Highlights}
+	}
+	err = svc.publish(ctx, "user.search", events)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to send Producer message: %v", err)
 	}
 
-	return &pb.ListUsersResponse{
-		Users:      users,
-		TotalCount: int32(totalCount),
+	return &pb.SearchUsersResponse{
+		Results:       results,
+		NextPageToken: nextPageToken,
 	}, nil
 }
 
-func (svc *UserService) produceMessage(message []byte) error {
-	msg := &sarama.ProducerMessage{
-		Topic: topic,
-		Value: sarama.StringEncoder(message),
+// countUsers computes total_count, estimates ignore filters so they are only
+// used when there are none. Estimates include the deleted users.
+func (svc *UserService) countUsers(ctx context.Context, mode pb.CountMode, filter Filter, showDeleted bool) (int64, pb.CountMode, error) {
+	switch {
+	case mode == pb.CountMode_COUNT_MODE_NONE:
+		return 0, mode, nil
+	case mode == pb.CountMode_COUNT_MODE_ESTIMATED && filter == nil:
+		count, err := svc.repository.EstimatedCount(ctx)
+		return count, mode, err
+	default:
+		count, err := svc.repository.Count(ctx, visibleUsers(filter, showDeleted))
+		return count, pb.CountMode_COUNT_MODE_EXACT, err
+	}
+}
+
+func (svc *UserService) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.User, error) {
+	if err := svc.passwordPolicy.Validate(req.NewPassword); err != nil {
+		var v violations
+		v.add("new_password", "%v", err)
+		return nil, v.err()
+	}
+
+	user, err := svc.getActiveUser(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !checkPassword(user.PasswordHash, req.CurrentPassword) {
+		return nil, status.Errorf(codes.PermissionDenied, "Current password is incorrect")
+	}
+
+	if req.NewPassword == req.CurrentPassword {
+		return nil, status.Errorf(codes.InvalidArgument, "New password must be different from the current one")
+	}
+
+	hashedPassword, err := svc.hashPassword(req.NewPassword)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to hash password: %v", err)
+	}
+
+	update := user.clone()
+	update.PasswordHash = hashedPassword
+	update.UpdatedAt = storeTime(time.Now())
+	update.Version++
+
+	// the event only says the password changed, never what it changed to
+	events, err := svc.outboxEvents("user.password_changed", update.Id, passwordChangedEvent{
+		Id:        update.Id,
+		ChangedAt: formatTime(update.UpdatedAt),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to serialize event: %v", err)
 	}
-	partition, offset, err := svc.kafkaProducer.SendMessage(msg)
+
+	updatedUser, err := svc.repository.Update(ctx, update, []string{"password"}, events...)
 	if err != nil {
-		return status.Errorf(codes.Internal, "Failed to produce message: %v", err)
+		return nil, writeError(err, "change password")
 	}
-	log.Printf("Message sent to topic(%s)/partition(%d)/offset(%d)\n", topic, partition, offset)
+	// a stolen refresh token doesn't survive the password change
+	if err := svc.revokeRefreshTokens(ctx, update.Id); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Password Changed:  %v", user.Id)
 
-	return nil
+	return svc.toProto(updatedUser), nil
 }
@@ -2,56 +2,39 @@ package grpc_user
 
 import (
 	"context"
-	"log"
+	"encoding/json"
 	"testing"
 
-	"github.com/IBM/sarama"
-	sarama_mock "github.com/IBM/sarama/mocks"
 	"github.com/stretchr/testify/require"
 	pb "github.com/zecst19/grpc-user/proto"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-)
-
-const (
-	port     = ":50051"
-	mongoURI = "mongodb://localhost:27017"
-	dbName   = "userTestDB"
+	"github.com/zecst19/grpc-user/server/auth"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestUserService(t *testing.T) {
 	ctx := context.Background()
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
-	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-	defer func() {
-		if err = client.Disconnect(ctx); err != nil {
-			log.Fatalf("Failed to disconnect from MongoDB: %v", err)
-		}
-	}()
-
-	// Check the connection
-	err = client.Ping(ctx, nil)
-	if err != nil {
-		log.Fatalf("Failed to ping MongoDB: %v", err)
-	}
 
 	// Create a new UserService instance
-	user_collection := client.Database(dbName).Collection("users_test")
-	mock_producer := sarama_mock.NewSyncProducer(t, sarama.NewConfig())
-	svc := NewUserService(user_collection, mock_producer)
-
-	user_collection.InsertOne(ctx, &pb.User{
-		Id:        "86f9f466-851a-4b93-af21-d5f52ac91006",
-		FirstName: "Cristiano",
-		LastName:  "Ronaldo",
-		Nickname:  "CR7",
-		Password:  "$2a$14$ol2a598AAUFAV3SizmaZJuvnBjfqA6CGzssNnCQ0Wn9Sr7vFxy5wy",
-		Email:     "cristiano@ronaldo.com",
-		Country:   "PT",
-		CreatedAt: "2025-03-22T18:37:00Z",
-		UpdatedAt: "2025-03-22T18:37:00Z",
+	user_repository := NewInMemoryUserRepository()
+	publisher := NewRecordingPublisher()
+	svc := NewUserService(user_repository, publisher)
+
+	user_repository.Create(ctx, &UserRecord{
+		Id:           "86f9f466-851a-4b93-af21-d5f52ac91006",
+		FirstName:    "Cristiano",
+		LastName:     "Ronaldo",
+		Nickname:     "CR7",
+		PasswordHash: "$2a$14$ol2a598AAUFAV3SizmaZJuvnBjfqA6CGzssNnCQ0Wn9Sr7vFxy5wy",
+		Email:        "cristiano@ronaldo.com",
+		Country:      "PT",
+		CreatedAt:    testTime("2025-03-22T18:37:00Z"),
+		UpdatedAt:    testTime("2025-03-22T18:37:00Z"),
 	},
 	)
 
@@ -73,8 +56,6 @@ func TestUserService(t *testing.T) {
 			Country:   "EG",
 		}
 
-		mock_producer.ExpectSendMessageAndSucceed()
-
 		resp, err := svc.CreateUser(context.Background(), in)
 		require.NoError(t, err)
 		require.Equal(t, expected_response.FirstName, resp.FirstName)
@@ -94,18 +75,18 @@ func TestUserService(t *testing.T) {
 			FirstName: "Cristiano",
 			LastName:  "Ronaldo",
 			Nickname:  "CR7",
-			Password:  "$2a$14$ol2a598AAUFAV3SizmaZJuvnBjfqA6CGzssNnCQ0Wn9Sr7vFxy5wy",
 			Email:     "cristiano@ronaldo.com",
 			Country:   "PT",
-			CreatedAt: "2025-03-22T18:37:00Z",
-			UpdatedAt: "2025-03-22T18:37:00Z",
-		}
+			CreatedAt: timestamppb.New(testTime("2025-03-22T18:37:00Z")),
+			UpdatedAt: timestamppb.New(testTime("2025-03-22T18:37:00Z")),
 
-		mock_producer.ExpectSendMessageAndSucceed()
+			LegacyCreatedAt: "2025-03-22T18:37:00Z",
+			LegacyUpdatedAt: "2025-03-22T18:37:00Z",
+		}
 
 		resp, err := svc.GetUser(context.Background(), in)
 		require.NoError(t, err)
-		require.Equal(t, expected_response, resp)
+		require.True(t, proto.Equal(expected_response, resp))
 
 	})
 
@@ -130,12 +111,10 @@ func TestUserService(t *testing.T) {
 			Nickname:  "Messi",
 			Email:     "cristiano@ronaldo.com",
 			Country:   "AR",
-			CreatedAt: "2025-03-22T18:37:00Z",
-			UpdatedAt: "2025-03-22T18:37:00Z",
+			CreatedAt: timestamppb.New(testTime("2025-03-22T18:37:00Z")),
+			UpdatedAt: timestamppb.New(testTime("2025-03-22T18:37:00Z")),
 		}
 
-		mock_producer.ExpectSendMessageAndSucceed()
-
 		resp, err := svc.UpdateUser(context.Background(), in)
 		require.NoError(t, err)
 		require.Equal(t, expected_response.FirstName, resp.FirstName)
@@ -143,8 +122,8 @@ func TestUserService(t *testing.T) {
 		require.Equal(t, expected_response.Nickname, resp.Nickname)
 		require.Equal(t, expected_response.Email, resp.Email)
 		require.Equal(t, expected_response.Country, resp.Country)
-		require.Equal(t, expected_response.CreatedAt, resp.CreatedAt)
-		require.NotEqual(t, expected_response.UpdatedAt, resp.UpdatedAt)
+		require.True(t, proto.Equal(expected_response.CreatedAt, resp.CreatedAt))
+		require.False(t, proto.Equal(expected_response.UpdatedAt, resp.UpdatedAt))
 
 	})
 
@@ -161,29 +140,25 @@ func TestUserService(t *testing.T) {
 					FirstName: "Lionel",
 					LastName:  "Messi",
 					Nickname:  "Messi",
-					Password:  "$2a$14$ol2a598AAUFAV3SizmaZJuvnBjfqA6CGzssNnCQ0Wn9Sr7vFxy5wy",
 					Email:     "cristiano@ronaldo.com",
 					Country:   "AR",
-					CreatedAt: "2025-03-22T18:37:00Z",
-					UpdatedAt: "2025-03-22T18:37:00Z",
+					CreatedAt: timestamppb.New(testTime("2025-03-22T18:37:00Z")),
+					UpdatedAt: timestamppb.New(testTime("2025-03-22T18:37:00Z")),
 				},
 				{
 					Id:        "4bedafd6-b946-4d70-a156-d828ddcb62fb",
 					FirstName: "Mohammed",
 					LastName:  "Salah",
 					Nickname:  "MoSalah",
-					Password:  "$2a$14$SpVoNKXfhSqGP4YTkh6H6ORQCoWxN9gQt3HHreNxKl8D0Gp1bn3oa",
 					Email:     "mo@salah.com",
 					Country:   "EG",
-					CreatedAt: "2025-03-22T18:37:00Z",
-					UpdatedAt: "2025-03-22T18:37:00Z",
+					CreatedAt: timestamppb.New(testTime("2025-03-22T18:37:00Z")),
+					UpdatedAt: timestamppb.New(testTime("2025-03-22T18:37:00Z")),
 				},
 			},
 			TotalCount: 2,
 		}
 
-		mock_producer.ExpectSendMessageAndSucceed()
-
 		resp, err := svc.ListUsers(context.Background(), in)
 		require.NoError(t, err)
 		require.Equal(t, len(expected_response.Users), len(resp.Users))
@@ -219,18 +194,15 @@ func TestUserService(t *testing.T) {
 					FirstName: "Mohammed",
 					LastName:  "Salah",
 					Nickname:  "MoSalah",
-					Password:  "$2a$14$SpVoNKXfhSqGP4YTkh6H6ORQCoWxN9gQt3HHreNxKl8D0Gp1bn3oa",
 					Email:     "mo@salah.com",
 					Country:   "EG",
-					CreatedAt: "2025-03-22T18:37:00Z",
-					UpdatedAt: "2025-03-22T18:37:00Z",
+					CreatedAt: timestamppb.New(testTime("2025-03-22T18:37:00Z")),
+					UpdatedAt: timestamppb.New(testTime("2025-03-22T18:37:00Z")),
 				},
 			},
-			TotalCount: 2,
+			TotalCount: 1,
 		}
 
-		mock_producer.ExpectSendMessageAndSucceed()
-
 		resp, err := svc.ListUsers(context.Background(), in)
 		require.NoError(t, err)
 		require.Equal(t, len(expected_response.Users), len(resp.Users))
@@ -241,7 +213,7 @@ func TestUserService(t *testing.T) {
 		require.Equal(t, expected_response.Users[0].Email, resp.Users[0].Email)
 		require.Equal(t, expected_response.Users[0].Country, resp.Users[0].Country)
 
-		require.Equal(t, expected_response.TotalCount, int32(2))
+		require.Equal(t, expected_response.TotalCount, resp.TotalCount)
 	})
 
 	t.Run("Delete User", func(t *testing.T) {
@@ -253,12 +225,556 @@ func TestUserService(t *testing.T) {
 			Success: true,
 		}
 
-		mock_producer.ExpectSendMessageAndSucceed()
-
 		resp, err := svc.DeleteUser(context.Background(), in)
 		require.NoError(t, err)
 		require.Equal(t, expected_response, resp)
 	})
 
-	client.Database(dbName).Collection("users_test").Drop(ctx)
+	t.Run("Published Events", func(t *testing.T) {
+		// read events are off by default
+		require.Empty(t, publisher.Events())
+
+		relay := NewOutboxRelay(user_repository, publisher)
+		delivered, err := relay.RelayOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 3, delivered)
+
+		require.Equal(t, []string{
+			"user.created",
+			"user.update",
+			"user.deleted",
+		}, publisher.Events())
+	})
+}
+
+func TestPasswordRedaction(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	publisher := NewRecordingPublisher()
+	svc := NewUserService(user_repository, publisher,
+		WithBcryptCost(bcrypt.MinCost),
+		WithEventPolicy("user.get", EventPolicy{Mode: DeliverySync}),
+		WithEventPolicy("user.list", EventPolicy{Mode: DeliverySync}),
+	)
+
+	t.Run("User Message Has No Credentials", func(t *testing.T) {
+		fields := (&pb.User{}).ProtoReflect().Descriptor().Fields()
+		for i := 0; i < fields.Len(); i++ {
+			require.NotContains(t, string(fields.Get(i).Name()), "password")
+		}
+	})
+
+	t.Run("No Hash Leaves The Service", func(t *testing.T) {
+		created, err := svc.CreateUser(ctx, &pb.CreateUserRequest{
+			FirstName: "Mohammed",
+			LastName:  "Salah",
+			Nickname:  "MoSalah",
+			Password:  "word5678",
+			Email:     "mo@salah.com",
+			Country:   "EG",
+		})
+		require.NoError(t, err)
+
+		stored, err := user_repository.Get(ctx, created.Id)
+		require.NoError(t, err)
+		require.NotEmpty(t, stored.PasswordHash)
+
+		newNickname := "MoSalah11"
+		fetched, err := svc.GetUser(ctx, &pb.GetUserRequest{Id: created.Id})
+		require.NoError(t, err)
+		updated, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{Id: created.Id, Nickname: &newNickname})
+		require.NoError(t, err)
+		listed, err := svc.ListUsers(ctx, &pb.ListUsersRequest{Page: 1, PageSize: 10})
+		require.NoError(t, err)
+
+		_, err = NewOutboxRelay(user_repository, publisher).RelayOnce(ctx)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"user.created", "user.get", "user.update", "user.list"}, publisher.Events())
+
+		var leaks []string
+		for _, resp := range []proto.Message{created, fetched, updated, listed} {
+			serialized, err := protojson.Marshal(resp)
+			require.NoError(t, err)
+			leaks = append(leaks, string(serialized))
+		}
+		for _, message := range publisher.Messages() {
+			serialized, err := json.Marshal(message)
+			require.NoError(t, err)
+			leaks = append(leaks, string(serialized))
+		}
+
+		for _, leak := range leaks {
+			require.NotContains(t, leak, stored.PasswordHash)
+			require.NotContains(t, leak, "$2a$")
+			require.NotContains(t, leak, "word5678")
+		}
+	})
+}
+
+func TestChangePassword(t *testing.T) {
+	ctx := context.Background()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("word5678"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	user_repository := NewInMemoryUserRepository()
+	user_repository.Create(ctx, &UserRecord{
+		Id:           "86f9f466-851a-4b93-af21-d5f52ac91006",
+		FirstName:    "Cristiano",
+		LastName:     "Ronaldo",
+		Nickname:     "CR7",
+		PasswordHash: string(hashedPassword),
+		Email:        "cristiano@ronaldo.com",
+		Country:      "PT",
+		CreatedAt:    testTime("2025-03-22T18:37:00Z"),
+		UpdatedAt:    testTime("2025-03-22T18:37:00Z"),
+	})
+
+	publisher := NewRecordingPublisher()
+	svc := NewUserService(user_repository, publisher, WithBcryptCost(bcrypt.MinCost))
+
+	t.Run("Wrong Current Password", func(t *testing.T) {
+		_, err := svc.ChangePassword(ctx, &pb.ChangePasswordRequest{
+			Id:              "86f9f466-851a-4b93-af21-d5f52ac91006",
+			CurrentPassword: "word1234",
+			NewPassword:     "siuuu2025",
+		})
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("Weak New Password", func(t *testing.T) {
+		_, err := svc.ChangePassword(ctx, &pb.ChangePasswordRequest{
+			Id:              "86f9f466-851a-4b93-af21-d5f52ac91006",
+			CurrentPassword: "word5678",
+			NewPassword:     "siuuu",
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("Unknown User", func(t *testing.T) {
+		_, err := svc.ChangePassword(ctx, &pb.ChangePasswordRequest{
+			Id:              "4bedafd6-b946-4d70-a156-d828ddcb62fb",
+			CurrentPassword: "word5678",
+			NewPassword:     "siuuu2025",
+		})
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("Change Password", func(t *testing.T) {
+		resp, err := svc.ChangePassword(ctx, &pb.ChangePasswordRequest{
+			Id:              "86f9f466-851a-4b93-af21-d5f52ac91006",
+			CurrentPassword: "word5678",
+			NewPassword:     "siuuu2025",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.UpdatedAt.AsTime().After(testTime("2025-03-22T18:37:00Z")))
+
+		stored, err := user_repository.Get(ctx, "86f9f466-851a-4b93-af21-d5f52ac91006")
+		require.NoError(t, err)
+		require.True(t, checkPassword(stored.PasswordHash, "siuuu2025"))
+		require.False(t, checkPassword(stored.PasswordHash, "word5678"))
+
+		_, err = NewOutboxRelay(user_repository, publisher).RelayOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"user.password_changed"}, publisher.Events())
+
+		serialized, err := json.Marshal(publisher.Messages()[0])
+		require.NoError(t, err)
+		require.NotContains(t, string(serialized), stored.PasswordHash)
+		require.NotContains(t, string(serialized), "siuuu2025")
+		require.NotContains(t, string(serialized), "word5678")
+	})
+
+	t.Run("Update User Rejects Password", func(t *testing.T) {
+		newPassword := "siuuu2026"
+		_, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{
+			Id:       "86f9f466-851a-4b93-af21-d5f52ac91006",
+			Password: &newPassword,
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("word5678"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	user_repository := NewInMemoryUserRepository()
+	user_repository.Create(ctx, &UserRecord{
+		Id:           "86f9f466-851a-4b93-af21-d5f52ac91006",
+		FirstName:    "Cristiano",
+		LastName:     "Ronaldo",
+		Nickname:     "CR7",
+		PasswordHash: string(hashedPassword),
+		Email:        "cristiano@ronaldo.com",
+		Country:      "PT",
+		CreatedAt:    testTime("2025-03-22T18:37:00Z"),
+		UpdatedAt:    testTime("2025-03-22T18:37:00Z"),
+	})
+
+	issuer := auth.NewHMACTokenIssuer([]byte("siuuu-secret"), auth.NewInMemoryTokenStore())
+	svc := NewUserService(user_repository, nil,
+		WithBcryptCost(bcrypt.MinCost),
+		WithTokenIssuer(issuer),
+	)
+
+	var tokens *pb.TokenResponse
+
+	t.Run("Authenticate With Email", func(t *testing.T) {
+		tokens, err = svc.Authenticate(ctx, &pb.AuthenticateRequest{
+			EmailOrNickname: "cristiano@ronaldo.com",
+			Password:        "word5678",
+		})
+		require.NoError(t, err)
+		require.Equal(t, "Bearer", tokens.TokenType)
+		require.NotEmpty(t, tokens.RefreshToken)
+
+		claims, err := issuer.Verify(ctx, tokens.AccessToken)
+		require.NoError(t, err)
+		require.Equal(t, "86f9f466-851a-4b93-af21-d5f52ac91006", claims.Subject)
+	})
+
+	t.Run("Authenticate With Nickname", func(t *testing.T) {
+		_, err := svc.Authenticate(ctx, &pb.AuthenticateRequest{
+			EmailOrNickname: "CR7",
+			Password:        "word5678",
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("Invalid Credentials", func(t *testing.T) {
+		_, err := svc.Authenticate(ctx, &pb.AuthenticateRequest{
+			EmailOrNickname: "CR7",
+			Password:        "word1234",
+		})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		_, err = svc.Authenticate(ctx, &pb.AuthenticateRequest{
+			EmailOrNickname: "Messi",
+			Password:        "word5678",
+		})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("Refresh Token", func(t *testing.T) {
+		refreshed, err := svc.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: tokens.RefreshToken})
+		require.NoError(t, err)
+		require.NotEqual(t, tokens.RefreshToken, refreshed.RefreshToken)
+
+		// refresh tokens are rotated
+		_, err = svc.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: tokens.RefreshToken})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		tokens = refreshed
+	})
+
+	t.Run("Revoke Token", func(t *testing.T) {
+		resp, err := svc.RevokeToken(ctx, &pb.RevokeTokenRequest{Token: tokens.AccessToken})
+		require.NoError(t, err)
+		require.True(t, resp.Success)
+
+		_, err = issuer.Verify(ctx, tokens.AccessToken)
+		require.ErrorIs(t, err, auth.ErrRevokedToken)
+	})
+
+	t.Run("Password Change Revokes Refresh Tokens", func(t *testing.T) {
+		_, err := svc.ChangePassword(ctx, &pb.ChangePasswordRequest{
+			Id:              "86f9f466-851a-4b93-af21-d5f52ac91006",
+			CurrentPassword: "word5678",
+			NewPassword:     "word91011",
+		})
+		require.NoError(t, err)
+
+		_, err = svc.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: tokens.RefreshToken})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("Delete Revokes Refresh Tokens", func(t *testing.T) {
+		tokens, err = svc.Authenticate(ctx, &pb.AuthenticateRequest{EmailOrNickname: "CR7", Password: "word91011"})
+		require.NoError(t, err)
+
+		_, err = svc.DeleteUser(ctx, &pb.DeleteUserRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.NoError(t, err)
+		_, err = svc.RestoreUser(ctx, &pb.RestoreUserRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006"})
+		require.NoError(t, err)
+
+		// restoring the user doesn't bring the tokens back
+		_, err = svc.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: tokens.RefreshToken})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("Not Configured", func(t *testing.T) {
+		_, err := NewUserService(user_repository, nil).Authenticate(ctx, &pb.AuthenticateRequest{
+			EmailOrNickname: "CR7",
+			Password:        "word5678",
+		})
+		require.Equal(t, codes.Unimplemented, status.Code(err))
+	})
+}
+
+func TestRoles(t *testing.T) {
+	ctx := context.Background()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("word5678"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	user_repository := NewInMemoryUserRepository()
+	user_repository.Create(ctx, &UserRecord{
+		Id:           "86f9f466-851a-4b93-af21-d5f52ac91006",
+		FirstName:    "Cristiano",
+		LastName:     "Ronaldo",
+		Nickname:     "CR7",
+		PasswordHash: string(hashedPassword),
+		Email:        "cristiano@ronaldo.com",
+		Country:      "PT",
+		CreatedAt:    testTime("2025-03-22T18:37:00Z"),
+		UpdatedAt:    testTime("2025-03-22T18:37:00Z"),
+	})
+
+	publisher := NewRecordingPublisher()
+	issuer := auth.NewHMACTokenIssuer([]byte("siuuu-secret"), auth.NewInMemoryTokenStore())
+	svc := NewUserService(user_repository, publisher, WithTokenIssuer(issuer))
+
+	t.Run("List Roles", func(t *testing.T) {
+		resp, err := svc.ListRoles(ctx, &pb.ListRolesRequest{})
+		require.NoError(t, err)
+		require.Len(t, resp.Roles, 2)
+		require.Equal(t, "admin", resp.Roles[0].Name)
+		require.Contains(t, resp.Roles[0].Permissions, PermissionUsersDelete)
+	})
+
+	t.Run("Assign Role", func(t *testing.T) {
+		resp, err := svc.AssignRole(ctx, &pb.AssignRoleRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006", Role: "support"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"support"}, resp.Roles)
+		require.Equal(t, []string{PermissionUsersRead, PermissionUsersList}, resp.Permissions)
+
+		// assigning it again changes nothing
+		resp, err = svc.AssignRole(ctx, &pb.AssignRoleRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006", Role: "support"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"support"}, resp.Roles)
+	})
+
+	t.Run("Unknown Role", func(t *testing.T) {
+		_, err := svc.AssignRole(ctx, &pb.AssignRoleRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006", Role: "president"})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = svc.AssignRole(ctx, &pb.AssignRoleRequest{Id: "4bedafd6-b946-4d70-a156-d828ddcb62fb", Role: "support"})
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("Roles Survive Update", func(t *testing.T) {
+		newNickname := "Cris"
+		resp, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006", Nickname: &newNickname})
+		require.NoError(t, err)
+		require.Equal(t, []string{"support"}, resp.Roles)
+	})
+
+	t.Run("Roles In Token", func(t *testing.T) {
+		tokens, err := svc.Authenticate(ctx, &pb.AuthenticateRequest{EmailOrNickname: "Cris", Password: "word5678"})
+		require.NoError(t, err)
+
+		claims, err := issuer.Verify(ctx, tokens.AccessToken)
+		require.NoError(t, err)
+		require.Equal(t, []string{"support"}, claims.Roles)
+		require.Equal(t, []string{PermissionUsersRead, PermissionUsersList}, claims.Permissions)
+	})
+
+	t.Run("Revoke Role", func(t *testing.T) {
+		resp, err := svc.RevokeRole(ctx, &pb.RevokeRoleRequest{Id: "86f9f466-851a-4b93-af21-d5f52ac91006", Role: "support"})
+		require.NoError(t, err)
+		require.Empty(t, resp.Roles)
+		require.Empty(t, resp.Permissions)
+	})
+
+	t.Run("Role Changed Events", func(t *testing.T) {
+		_, err := NewOutboxRelay(user_repository, publisher).RelayOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"user.role_changed", "user.update", "user.role_changed"}, publisher.Events())
+
+		var event roleChangedEvent
+		require.NoError(t, json.Unmarshal(publisher.Messages()[2].Value.(json.RawMessage), &event))
+		require.Equal(t, roleChangedEvent{
+			Id:     "86f9f466-851a-4b93-af21-d5f52ac91006",
+			Role:   "support",
+			Action: "revoked",
+			Roles:  []string{},
+		}, event)
+	})
+}
+
+func TestUniqueness(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	svc := NewUserService(user_repository, nil, WithBcryptCost(bcrypt.MinCost))
+
+	cristiano, err := svc.CreateUser(ctx, &pb.CreateUserRequest{
+		FirstName: "Cristiano",
+		LastName:  "Ronaldo",
+		Nickname:  "CR7",
+		Password:  "word5678",
+		Email:     " Cristiano@Ronaldo.com ",
+		Country:   "PT",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "cristiano@ronaldo.com", cristiano.Email)
+
+	mo, err := svc.CreateUser(ctx, &pb.CreateUserRequest{
+		FirstName: "Mohammed",
+		LastName:  "Salah",
+		Nickname:  "MoSalah",
+		Password:  "word5678",
+		Email:     "mo@salah.com",
+		Country:   "EG",
+	})
+	require.NoError(t, err)
+
+	conflictField := func(t *testing.T, err error) string {
+		st, ok := status.FromError(err)
+		require.True(t, ok)
+		require.Equal(t, codes.AlreadyExists, st.Code())
+
+		for _, detail := range st.Details() {
+			if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+				require.Len(t, badRequest.FieldViolations, 1)
+				return badRequest.FieldViolations[0].Field
+			}
+		}
+		t.Fatal("missing BadRequest detail")
+		return ""
+	}
+
+	t.Run("Create Duplicate Email", func(t *testing.T) {
+		_, err := svc.CreateUser(ctx, &pb.CreateUserRequest{
+			FirstName: "Cristiano",
+			LastName:  "Ronaldo",
+			Nickname:  "CR7Jr",
+			Password:  "word5678",
+			Email:     "CRISTIANO@ronaldo.com",
+			Country:   "PT",
+		})
+		require.Equal(t, "email", conflictField(t, err))
+	})
+
+	t.Run("Create Duplicate Nickname", func(t *testing.T) {
+		_, err := svc.CreateUser(ctx, &pb.CreateUserRequest{
+			FirstName: "Cristiano",
+			LastName:  "Ronaldo",
+			Nickname:  "CR7",
+			Password:  "word5678",
+			Email:     "cr7@ronaldo.com",
+			Country:   "PT",
+		})
+		require.Equal(t, "nickname", conflictField(t, err))
+	})
+
+	t.Run("Update To Taken Email", func(t *testing.T) {
+		email := "Cristiano@ronaldo.com"
+		_, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{Id: mo.Id, Email: &email})
+		require.Equal(t, "email", conflictField(t, err))
+	})
+
+	t.Run("Update Keeping Own Email", func(t *testing.T) {
+		email := "CRISTIANO@RONALDO.COM"
+		resp, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{Id: cristiano.Id, Email: &email})
+		require.NoError(t, err)
+		require.Equal(t, "cristiano@ronaldo.com", resp.Email)
+	})
+
+	t.Run("Index Race", func(t *testing.T) {
+		// a write that passed CheckUnique can still lose against the repository
+		err := user_repository.Create(ctx, &UserRecord{Id: "4bedafd6-b946-4d70-a156-d828ddcb62fb", Nickname: "MoSalah"})
+		var duplicate *DuplicateError
+		require.ErrorAs(t, err, &duplicate)
+		require.Equal(t, "nickname", duplicate.Field)
+		require.Equal(t, "nickname", conflictField(t, writeError(err, "create user")))
+	})
+
+	t.Run("Login Is Case Insensitive", func(t *testing.T) {
+		user, err := user_repository.FindByLogin(ctx, "MO@Salah.com")
+		require.NoError(t, err)
+		require.Equal(t, mo.Id, user.Id)
+	})
+}
+
+// racingRepository changes the user right after the service reads it
+type racingRepository struct {
+	*InMemoryUserRepository
+	race func()
+}
+
+func (repo *racingRepository) Get(ctx context.Context, id string, fields ...string) (*UserRecord, error) {
+	user, err := repo.InMemoryUserRepository.Get(ctx, id, fields...)
+	if race := repo.race; race != nil {
+		repo.race = nil
+		race()
+	}
+	return user, err
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := &racingRepository{InMemoryUserRepository: NewInMemoryUserRepository()}
+	svc := NewUserService(user_repository, nil, WithBcryptCost(bcrypt.MinCost))
+
+	user, err := svc.CreateUser(ctx, &pb.CreateUserRequest{
+		FirstName: "Cristiano",
+		LastName:  "Ronaldo",
+		Nickname:  "CR7",
+		Password:  "word5678",
+		Email:     "cristiano@ronaldo.com",
+		Country:   "PT",
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), user.Version)
+
+	t.Run("Update With Expected Version", func(t *testing.T) {
+		nickname := "Cris"
+		resp, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, Nickname: &nickname, ExpectedVersion: &user.Version})
+		require.NoError(t, err)
+		require.Equal(t, int64(2), resp.Version)
+	})
+
+	t.Run("Stale Expected Version", func(t *testing.T) {
+		nickname := "CR7"
+		_, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, Nickname: &nickname, ExpectedVersion: &user.Version})
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+		stored, err := user_repository.Get(ctx, user.Id)
+		require.NoError(t, err)
+		require.Equal(t, "Cris", stored.Nickname)
+	})
+
+	t.Run("Concurrent Update Is Aborted", func(t *testing.T) {
+		user_repository.race = func() {
+			roles, err := svc.AssignRole(ctx, &pb.AssignRoleRequest{Id: user.Id, Role: SupportRole})
+			require.NoError(t, err)
+			require.Equal(t, int64(3), roles.Version)
+		}
+
+		country := "ES"
+		_, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, Country: &country})
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		// the role assigned in between is kept
+		stored, err := user_repository.Get(ctx, user.Id)
+		require.NoError(t, err)
+		require.Equal(t, "PT", stored.Country)
+		require.Equal(t, []string{SupportRole}, stored.Roles)
+		require.Equal(t, int64(3), stored.Version)
+	})
+
+	t.Run("Stale Repository Write", func(t *testing.T) {
+		stale, err := user_repository.Get(ctx, user.Id)
+		require.NoError(t, err)
+
+		stale.Version = 2
+		_, err = user_repository.Update(ctx, stale, nil)
+		require.ErrorIs(t, err, ErrVersionConflict)
+	})
 }
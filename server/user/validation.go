@@ -0,0 +1,221 @@
+package grpc_user
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/zecst19/grpc-user/proto"
+)
+
+const (
+	maxNameLength     = 100
+	minNicknameLength = 3
+	maxNicknameLength = 30
+	maxEmailLength    = 254
+)
+
+var (
+	nicknamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// violations collects the invalid fields of a request, the field names are the
+// proto field names so clients can map them to their forms
+type violations []*errdetails.BadRequest_FieldViolation
+
+func (v *violations) add(field string, format string, args ...any) {
+	*v = append(*v, &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: fmt.Sprintf(format, args...),
+	})
+}
+
+// err returns an InvalidArgument status with a BadRequest detail, or nil if
+// there are no violations
+func (v violations) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+
+	fields := make([]string, len(v))
+	for i, violation := range v {
+		fields[i] = violation.Field
+	}
+
+	st := status.Newf(codes.InvalidArgument, "Invalid fields: %s", strings.Join(fields, ", "))
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: v})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// alreadyExists returns an AlreadyExists status naming the taken field in a
+// BadRequest detail
+func alreadyExists(field string) error {
+	st := status.Newf(codes.AlreadyExists, "A user with this %s already exists", field)
+	detailed, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: field, Description: "is already in use"},
+		},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// writeError maps the repository errors shared by all writes, action is used
+// in the Internal error message
+func writeError(err error, action string) error {
+	var duplicate *DuplicateError
+	switch {
+	case errors.As(err, &duplicate):
+		return alreadyExists(duplicate.Field)
+	case errors.Is(err, ErrUserNotFound):
+		return status.Errorf(codes.NotFound, "User not found")
+	case errors.Is(err, ErrVersionConflict):
+		return status.Errorf(codes.Aborted, "User was modified concurrently, read it again and retry")
+	default:
+		return status.Errorf(codes.Internal, "Failed to %s: %v", action, err)
+	}
+}
+
+func (svc *UserService) validateCreateUser(req *pb.CreateUserRequest) error {
+	var v violations
+	validateName(&v, "first_name", req.FirstName)
+	validateName(&v, "last_name", req.LastName)
+	validateNickname(&v, "nickname", req.Nickname)
+	validateEmail(&v, "email", normalizeEmail(req.Email))
+	validateCountry(&v, "country", req.Country)
+	if err := svc.passwordPolicy.Validate(req.Password); err != nil {
+		v.add("password", "%v", err)
+	}
+	return v.err()
+}
+
+// validateUpdateUser checks the mask and the values of the fields it changes,
+// nickname is the only one that may be cleared
+func (svc *UserService) validateUpdateUser(req *pb.UpdateUserRequest, paths []string) error {
+	var v violations
+	if req.Password != nil {
+		v.add("password", "password can't be changed with UpdateUser, use ChangePassword")
+	}
+	if req.UpdateMask != nil {
+		validateUpdateMask(&v, "update_mask", req.UpdateMask.Paths)
+	}
+
+	for _, path := range paths {
+		value := requestField(req, path)
+		switch path {
+		case "first_name", "last_name":
+			validateName(&v, path, value)
+		case "nickname":
+			if value != "" {
+				validateNickname(&v, path, value)
+			}
+		case "email":
+			validateEmail(&v, path, normalizeEmail(value))
+		case "country":
+			validateCountry(&v, path, value)
+		}
+	}
+	return v.err()
+}
+
+// validatePaging checks the paging and count fields of ListUsers and returns the page
+// size to use, sizes above MaxPageSize are clamped
+func validatePaging(v *violations, req *pb.ListUsersRequest) int {
+	if req.Page < 0 {
+		v.add("page", "must not be negative")
+	}
+	if req.Page > 0 && req.PageToken != "" {
+		v.add("page_token", "can't be combined with page")
+	}
+	if _, ok := pb.CountMode_name[int32(req.CountMode)]; !ok {
+		v.add("count_mode", "unknown count mode %d", req.CountMode)
+	}
+	return validatePageSize(v, req.PageSize)
+}
+
+func validatePageSize(v *violations, pageSize int32) int {
+	switch {
+	case pageSize < 0:
+		v.add("page_size", "must not be negative")
+		return 0
+	case pageSize == 0:
+		return DefaultPageSize
+	case pageSize > MaxPageSize:
+		return MaxPageSize
+	default:
+		return int(pageSize)
+	}
+}
+
+// validateSearch checks the query of SearchUsers and returns its terms
+func validateSearch(v *violations, req *pb.SearchUsersRequest) []string {
+	terms := searchTerms(req.Query)
+	switch {
+	case strings.TrimSpace(req.Query) == "":
+		v.add("query", "must not be empty")
+	case utf8.RuneCountInString(req.Query) > maxQueryLength:
+		v.add("query", "must be at most %d characters long", maxQueryLength)
+	case len(terms) == 0:
+		v.add("query", "must contain a word of at least %d letters or digits", minTermLength)
+	case len(terms) > maxSearchTerms:
+		v.add("query", "must have at most %d words", maxSearchTerms)
+	}
+	return terms
+}
+
+func validateName(v *violations, field string, name string) {
+	length := utf8.RuneCountInString(strings.TrimSpace(name))
+	switch {
+	case length == 0:
+		v.add(field, "must not be empty")
+	case length > maxNameLength:
+		v.add(field, "must be at most %d characters long", maxNameLength)
+	}
+}
+
+func validateNickname(v *violations, field string, nickname string) {
+	length := len(nickname)
+	switch {
+	case length < minNicknameLength || length > maxNicknameLength:
+		v.add(field, "must be between %d and %d characters long", minNicknameLength, maxNicknameLength)
+	case !nicknamePattern.MatchString(nickname):
+		v.add(field, "may only contain letters, digits, '_', '.' and '-'")
+	}
+}
+
+func validateEmail(v *violations, field string, email string) {
+	if len(email) > maxEmailLength {
+		v.add(field, "must be at most %d characters long", maxEmailLength)
+		return
+	}
+
+	// ParseAddress also accepts display names and comments, only a bare address is valid here
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" || address.Address != email {
+		v.add(field, "must be a valid email address")
+		return
+	}
+
+	_, domain, _ := strings.Cut(email, "@")
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		v.add(field, "must be a valid email address")
+	}
+}
+
+func validateCountry(v *violations, field string, country string) {
+	if !isCountryCode(country) {
+		v.add(field, "must be an ISO 3166-1 alpha-2 country code, e.g. PT")
+	}
+}
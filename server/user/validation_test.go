@@ -0,0 +1,104 @@
+package grpc_user
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zecst19/grpc-user/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fieldViolations returns the fields named in the BadRequest detail of err
+func fieldViolations(t *testing.T, err error) []string {
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+
+	var fields []string
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.FieldViolations {
+				fields = append(fields, violation.Field)
+			}
+		}
+	}
+	return fields
+}
+
+func TestValidation(t *testing.T) {
+	ctx := context.Background()
+
+	user_repository := NewInMemoryUserRepository()
+	user_repository.Create(ctx, &UserRecord{Id: "86f9f466-851a-4b93-af21-d5f52ac91006", Country: "PT"})
+
+	svc := NewUserService(user_repository, nil)
+
+	valid := func() *pb.CreateUserRequest {
+		return &pb.CreateUserRequest{
+			FirstName: "Mohammed",
+			LastName:  "Salah",
+			Nickname:  "MoSalah",
+			Password:  "word5678",
+			Email:     "mo@salah.com",
+			Country:   "EG",
+		}
+	}
+
+	t.Run("Valid Create Request", func(t *testing.T) {
+		require.NoError(t, svc.validateCreateUser(valid()))
+	})
+
+	t.Run("Empty Create Request", func(t *testing.T) {
+		_, err := svc.CreateUser(ctx, &pb.CreateUserRequest{})
+		require.Equal(t, []string{"first_name", "last_name", "nickname", "email", "country", "password"}, fieldViolations(t, err))
+	})
+
+	tests := map[string]struct {
+		modify func(req *pb.CreateUserRequest)
+		field  string
+	}{
+		"Blank Name":           {func(req *pb.CreateUserRequest) { req.FirstName = "   " }, "first_name"},
+		"Long Name":            {func(req *pb.CreateUserRequest) { req.LastName = string(make([]rune, 101)) }, "last_name"},
+		"Short Nickname":       {func(req *pb.CreateUserRequest) { req.Nickname = "Mo" }, "nickname"},
+		"Nickname Charset":     {func(req *pb.CreateUserRequest) { req.Nickname = "Mo Salah" }, "nickname"},
+		"Email Without At":     {func(req *pb.CreateUserRequest) { req.Email = "mo.salah.com" }, "email"},
+		"Email Without Domain": {func(req *pb.CreateUserRequest) { req.Email = "mo@salah" }, "email"},
+		"Email Display Name":   {func(req *pb.CreateUserRequest) { req.Email = "Mo <mo@salah.com>" }, "email"},
+		"Lowercase Country":    {func(req *pb.CreateUserRequest) { req.Country = "eg" }, "country"},
+		"Unknown Country":      {func(req *pb.CreateUserRequest) { req.Country = "XX" }, "country"},
+		"Country Name":         {func(req *pb.CreateUserRequest) { req.Country = "Egypt" }, "country"},
+		"Weak Password":        {func(req *pb.CreateUserRequest) { req.Password = "salah" }, "password"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := valid()
+			test.modify(req)
+
+			_, err := svc.CreateUser(ctx, req)
+			require.Equal(t, []string{test.field}, fieldViolations(t, err))
+		})
+	}
+
+	t.Run("Update Only Checks Present Fields", func(t *testing.T) {
+		badEmail := "mo.salah.com"
+		badCountry := "Portugal"
+
+		_, err := svc.UpdateUser(ctx, &pb.UpdateUserRequest{
+			Id:      "86f9f466-851a-4b93-af21-d5f52ac91006",
+			Email:   &badEmail,
+			Country: &badCountry,
+		})
+		require.Equal(t, []string{"email", "country"}, fieldViolations(t, err))
+
+		newCountry := "ES"
+		_, err = svc.UpdateUser(ctx, &pb.UpdateUserRequest{
+			Id:      "86f9f466-851a-4b93-af21-d5f52ac91006",
+			Country: &newCountry,
+		})
+		require.NoError(t, err)
+	})
+}